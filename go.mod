@@ -6,13 +6,15 @@ require (
 	github.com/PCManiac/compile_vars v0.0.0
 	github.com/PCManiac/logrus_init v0.0.0
 	github.com/caarlos0/env/v6 v6.10.1
+	github.com/disintegration/imaging v1.6.2
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.3.0
 	github.com/jmoiron/sqlx v1.3.5
-	github.com/jung-kurt/gofpdf v1.16.2 // indirect
+	github.com/jung-kurt/gofpdf v1.16.2
 	github.com/labstack/echo/v4 v4.11.1
 	github.com/labstack/gommon v0.4.0
 	github.com/lib/pq v1.10.9
+	github.com/minio/minio-go/v7 v7.0.50
 	github.com/mrFokin/jrpc v0.9.3
 	github.com/mrFokin/sessions v0.9.1
 	github.com/pkg/errors v0.9.1
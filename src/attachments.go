@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/lib/pq"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type cfgAttachments struct {
+	MaxSize int64 `env:"ATTACHMENT_MAX_SIZE" envDefault:"209715200"`
+	// Квота клуба по умолчанию, переопределяется параметром клуба attachments_quota
+	ClubQuota int64 `env:"ATTACHMENT_CLUB_QUOTA" envDefault:"5368709120"`
+}
+
+var (
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+	ErrAttachmentQuota    = errors.New("club attachments quota exceeded")
+)
+
+// Запас на заголовки multipart-формы и поле split_id сверх ATTACHMENT_MAX_SIZE
+const attachmentFormOverhead int64 = 1 << 20
+
+// Ограничение тела запроса загрузки: больший запрос отклоняется до того, как форма будет сохранена на диск
+func (h *handler) attachmentBodyLimit() echo.MiddlewareFunc {
+	return middleware.BodyLimit(strconv.FormatInt(h.cfg.Attachments.MaxSize+attachmentFormOverhead, 10))
+}
+
+// Вложение тренировки или отдельного сплита: схемы упражнений, видео, PDF
+type AttachmentInfo struct {
+	Id         int32     `json:"id" db:"id"`
+	EventId    string    `json:"event_id" db:"event_id"`
+	SplitId    *string   `json:"split_id" db:"split_id"`
+	FileData   FileInfo  `json:"file_data" db:"file_data"`
+	CreateTime time.Time `json:"create_time" db:"create_time"`
+	UserId     string    `json:"user_id" db:"user_id"`
+}
+
+type AttachmentsUsage struct {
+	Used  int64 `json:"used"`
+	Quota int64 `json:"quota"`
+}
+
+// Квота клуба на суммарный размер вложений
+func (h *handler) attachmentsQuota(club_id interface{}) int64 {
+	club_info := new(ClubInfo)
+	err := h.DB.QueryRow(`SELECT * FROM api_sight."clubGetById"($1);`, club_id).Scan(&club_info.Id, &club_info.Name, &club_info.CreateTime, &club_info.UpdateTime, &club_info.Params)
+	if err != nil {
+		return h.cfg.Attachments.ClubQuota
+	}
+
+	switch quota := club_info.Params["attachments_quota"].(type) {
+	case float64:
+		return int64(quota)
+	}
+	return h.cfg.Attachments.ClubQuota
+}
+
+func (h *handler) attachmentsUsage(club_id interface{}) (usage AttachmentsUsage, err error) {
+	if err := h.DB.Get(&usage.Used, `select * from api_sight."attachmentsClubUsage"($1);`, club_id); err != nil {
+		return usage, errors.Wrap(err, "attachmentsClubUsage SQL error")
+	}
+	usage.Quota = h.attachmentsQuota(club_id)
+	return usage, nil
+}
+
+/*
+Проверяет, что тренировка есть в клубе. Для токена игрока - что игрок в ней участвовал
+*/
+func (h *handler) attachmentEventCheck(club_id interface{}, event_id string, player_id *int32) error {
+	var event EventInfo
+
+	query := `select * from api_sight."eventGet"($1, $2);`
+	args := []interface{}{club_id, event_id}
+	if player_id != nil {
+		query = `select * from api_sight."eventGetPlayer"($1, $2, $3);`
+		args = append(args, *player_id)
+	}
+
+	return h.DB.Get(&event, query, args...)
+}
+
+// Тип содержимого определяется по данным, для неизвестных данных - по расширению имени файла
+func attachmentMimeType(src io.ReadSeeker, filename string) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	mime_type := http.DetectContentType(head[:n])
+	if mime_type == "application/octet-stream" {
+		if by_ext := mime.TypeByExtension(path.Ext(filename)); by_ext != "" {
+			mime_type = by_ext
+		}
+	}
+	return mime_type, nil
+}
+
+/*
+Загрузка вложения к тренировке. Файл из поля "file" формы, необязательное поле "split_id"
+привязывает вложение к сплиту этой тренировки
+*/
+func (h *handler) uploadEventAttachment(c echo.Context) error {
+	event_id := c.Param("id")
+
+	claims := c.Get("user").(*jwt.Token).Claims.(*UserClaims)
+	user_id := claims.ID
+	club_id := int(claims.Data["club_id"].(float64))
+
+	if claimsPlayerID(claims) != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
+	ctx := c.Request().Context()
+
+	if err := h.attachmentEventCheck(club_id, event_id, nil); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	var split_id *string
+	if split := c.FormValue("split_id"); split != "" {
+		var splits []SplitsInfo
+		if err := h.DB.Select(&splits, `select * from api_sight."splitsList"($1, $2);`, club_id, pq.StringArray([]string{event_id})); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		for i := range splits {
+			if splits[i].Id == split {
+				split_id = &splits[i].Id
+				break
+			}
+		}
+		if split_id == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "split not found")
+		}
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if file.Size > h.cfg.Attachments.MaxSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, ErrAttachmentTooLarge.Error())
+	}
+
+	// Предварительная проверка, чтобы не сохранять файл сверх квоты. Окончательно квота проверяется в attachmentsAdd
+	usage, err := h.attachmentsUsage(club_id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if usage.Used+file.Size > usage.Quota {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, ErrAttachmentQuota.Error())
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer src.Close()
+
+	mime_type, err := attachmentMimeType(src, file.Filename)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	file_info := FileInfo{
+		OriginalfileName: file.Filename,
+		FileSize:         file.Size,
+		MimeType:         mime_type,
+	}
+
+	file_info.FileSystemName, file_info.Hash, err = h.putBlobReader(ctx, src, file.Size, mime_type)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	js_file_info, err := json.Marshal(file_info)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// attachmentsAdd блокирует клуб до конца транзакции и проверяет квоту вместе с добавлением,
+	// поэтому параллельные загрузки не превышают ее в сумме
+	var attachment_id *int
+	err = h.DB.QueryRow(`SELECT * FROM api_sight."attachmentsAdd"($1, $2, $3, $4, $5, $6);`,
+		club_id, event_id, split_id, string(js_file_info), user_id, usage.Quota).Scan(&attachment_id)
+	if err != nil && strings.Contains(err.Error(), "Attachments quota exceeded") {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, ErrAttachmentQuota.Error())
+	}
+	if err != nil {
+		c.Echo().Logger.Errorj(map[string]interface{}{
+			"error":    err,
+			"proc":     "uploadEventAttachment",
+			"club_id":  club_id,
+			"event_id": event_id,
+			"message":  "SQL error",
+		})
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"result": true,
+		"data":   attachment_id,
+	})
+}
+
+// Скачивание вложения. Изображения, видео и PDF открываются в браузере, остальное сохраняется файлом
+func (h *handler) getEventAttachment(c echo.Context) error {
+	attachment_id := c.Param("id")
+
+	claims := c.Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := int(claims.Data["club_id"].(float64))
+
+	var attachment AttachmentInfo
+	if err := h.DB.Get(&attachment, `select * from api_sight."attachmentsGet"($1, $2);`, club_id, attachment_id); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	if player_id := claimsPlayerID(claims); player_id != nil {
+		if err := h.attachmentEventCheck(club_id, attachment.EventId, player_id); err != nil {
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
+	}
+
+	file := attachment.FileData
+
+	disposition := "attachment"
+	switch path.Dir(file.MimeType) {
+	case "image", "video", "audio":
+		disposition = "inline"
+	}
+	switch file.MimeType {
+	case "application/pdf":
+		disposition = "inline"
+	case "image/svg+xml":
+		// SVG может содержать скрипты, в браузере не открывается
+		disposition = "attachment"
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentDisposition, mime.FormatMediaType(disposition, map[string]string{"filename": file.OriginalfileName}))
+	header.Set("X-Content-Type-Options", "nosniff")
+
+	return h.serveStorageFile(c, file.FileSystemName, file.MimeType, file.Hash)
+}
+
+func (h *handler) eventAttachmentsList(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := claims.Data["club_id"]
+
+	var params struct {
+		EventId string  `json:"event_id"`
+		SplitId *string `json:"split_id"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "eventAttachmentsList Bind error")
+	}
+
+	if err := h.attachmentEventCheck(club_id, params.EventId, h.requestPlayerID(c)); err != nil {
+		return ErrorNotFound
+	}
+
+	data := []AttachmentInfo{}
+	if err := h.DB.Select(&data, `select * from api_sight."attachmentsList"($1, $2, $3);`, club_id, params.EventId, params.SplitId); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "eventAttachmentsList",
+			"event_id": params.EventId,
+			"error":    err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Удаление вложения. Файл освобождается, если на него больше нет ссылок
+func (h *handler) eventAttachmentsDelete(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := claims.Data["club_id"]
+
+	var id int32
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "eventAttachmentsDelete Bind error")
+	}
+
+	var file_info FileInfo
+	if err := h.DB.Get(&file_info, `select * from api_sight."attachmentsRm"($1, $2, $3);`, club_id, id, claims.ID); err != nil {
+		log.WithFields(log.Fields{
+			"proc":          "eventAttachmentsDelete",
+			"attachment_id": id,
+			"error":         err,
+		}).Error("SQL error")
+		return ErrorNotFound
+	}
+	if file_info.FileSystemName == "" {
+		return ErrorNotFound
+	}
+
+	h.removeFiles(c.EchoContext().Request().Context(), file_info)
+
+	return c.Result(true)
+}
+
+// Занятое вложениями место и квота клуба
+func (h *handler) eventAttachmentsUsage(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := claims.Data["club_id"]
+
+	usage, err := h.attachmentsUsage(club_id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "eventAttachmentsUsage",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(usage)
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type cfgAudit struct {
+	Enabled bool `env:"AUDIT_ENABLED" envDefault:"true"`
+	// Сколько хранить записи журнала и исходные тела event.save. 0 - бессрочно / не сохранять тела
+	Retention    time.Duration `env:"AUDIT_RETENTION" envDefault:"2160h"`
+	RawRetention time.Duration `env:"AUDIT_RAW_RETENTION" envDefault:"720h"`
+	Interval     time.Duration `env:"AUDIT_RETENTION_INTERVAL" envDefault:"24h"`
+	// Тело JSON-RPC больше этого размера в журнал не разбирается, метод записывается как "rpc"
+	MaxBody int64 `env:"AUDIT_MAX_BODY" envDefault:"33554432"`
+	// Очередь записи журнала: записей, объем тел event.save в байтах и число потоков записи
+	Queue      int   `env:"AUDIT_QUEUE" envDefault:"1024"`
+	QueueBytes int64 `env:"AUDIT_QUEUE_BYTES" envDefault:"268435456"`
+	Workers    int   `env:"AUDIT_WORKERS" envDefault:"2"`
+}
+
+// Итог вызова в журнале репликации
+const (
+	AuditOk           string = "ok"
+	AuditError        string = "error"
+	AuditUnauthorized string = "unauthorized"
+)
+
+// Запись журнала репликации. RawName - исходное тело event.save в хранилище, пока не истек срок хранения
+type ReplicationAuditEntry struct {
+	Id           int64     `json:"id" db:"id"`
+	CallTime     time.Time `json:"call_time" db:"call_time"`
+	Method       string    `json:"method" db:"method"`
+	BoardId      *string   `json:"board_id" db:"board_id"`
+	ClubId       *int32    `json:"club_id" db:"club_id"`
+	RequestId    *string   `json:"request_id" db:"request_id"`
+	RequestSize  int64     `json:"request_size" db:"request_size"`
+	Status       int       `json:"status" db:"status"`
+	Outcome      string    `json:"outcome" db:"outcome"`
+	ErrorCode    *int      `json:"error_code" db:"error_code"`
+	ErrorMessage *string   `json:"error_message" db:"error_message"`
+	DurationMs   int64     `json:"duration_ms" db:"duration_ms"`
+	PayloadHash  *string   `json:"payload_hash" db:"payload_hash"`
+	RawName      *string   `json:"-" db:"raw_name"`
+	HasRaw       bool      `json:"has_raw" db:"-"`
+}
+
+// Начало ответа, по которому определяется ошибка JSON-RPC
+type auditResponseWriter struct {
+	http.ResponseWriter
+	head bytes.Buffer
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if rest := 4096 - w.head.Len(); rest > 0 {
+		if len(b) < rest {
+			rest = len(b)
+		}
+		w.head.Write(b[:rest])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type auditRPC struct {
+	Method string `json:"method"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+/*
+Тело запроса, прочитанное обработчиком, не больше max байт. Журнал сам тело не читает:
+запрос, отклоненный BasicAuth, так и остается непрочитанным и записывается без тела
+*/
+type auditBodyReader struct {
+	io.ReadCloser
+	max      int64
+	size     int64
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *auditBodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.size += int64(n)
+	if n > 0 && !r.overflow {
+		if int64(r.body.Len()+n) > r.max {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (r *auditBodyReader) bytes() []byte {
+	if r.overflow {
+		return nil
+	}
+	return r.body.Bytes()
+}
+
+/*
+Журнал вызовов репликации. Ставится перед BasicAuth, чтобы отклоненные запросы тоже попадали в журнал
+(board_id для них - имя из BasicAuth). Для JSON-RPC записывается метод из тела и код ошибки из ответа,
+для event.save - contentHash выгрузки и само тело, если AUDIT_RAW_RETENTION больше нуля.
+Тело запоминается по мере чтения обработчиками после BasicAuth (auditBodyReader).
+Запись выполняется очередью после ответа и не задерживает плату
+*/
+func (h *handler) ReplicationAudit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !h.cfg.Audit.Enabled {
+			return next(c)
+		}
+
+		start := time.Now()
+		req := c.Request()
+		entry := ReplicationAuditEntry{
+			CallTime:    start,
+			Method:      req.Method + " " + c.Path(),
+			RequestSize: req.ContentLength,
+		}
+		if req_id := req.Header.Get(headerRequestId); req_id != "" {
+			entry.RequestId = &req_id
+		}
+
+		rpc := req.Method == http.MethodPost && strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON)
+		var reader *auditBodyReader
+		if rpc && req.Body != nil && req.Body != http.NoBody {
+			reader = &auditBodyReader{ReadCloser: req.Body, max: h.cfg.Audit.MaxBody}
+			req.Body = reader
+		}
+
+		capture := &auditResponseWriter{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = capture
+
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		var body []byte
+		if reader != nil {
+			body = reader.bytes()
+			if entry.RequestSize < 0 {
+				entry.RequestSize = reader.size
+			}
+		}
+		if rpc {
+			entry.Method = "rpc"
+			var call auditRPC
+			if body != nil && json.Unmarshal(body, &call) == nil && call.Method != "" {
+				entry.Method = call.Method
+			}
+		}
+
+		entry.DurationMs = time.Since(start).Milliseconds()
+		entry.Status = c.Response().Status
+		switch {
+		case entry.Status == http.StatusUnauthorized:
+			entry.Outcome = AuditUnauthorized
+		case entry.Status >= http.StatusBadRequest:
+			entry.Outcome = AuditError
+		default:
+			entry.Outcome = AuditOk
+		}
+		if rpc && entry.Outcome == AuditOk {
+			var result auditRPC
+			if json.Unmarshal(capture.head.Bytes(), &result) == nil && result.Error != nil {
+				entry.Outcome = AuditError
+				entry.ErrorCode = &result.Error.Code
+				entry.ErrorMessage = &result.Error.Message
+			}
+		}
+
+		if board_id, ok := c.Get("board_id").(string); ok {
+			entry.BoardId = &board_id
+		} else if username, _, ok := req.BasicAuth(); ok {
+			entry.BoardId = &username
+		}
+		if club_id, ok := c.Get("club_id").(int32); ok {
+			entry.ClubId = &club_id
+		}
+
+		// Хэш ставит saveCalculatedEvent, когда выгрузка прочитана целиком
+		var raw []byte
+		if hash, ok := c.Get("payload_hash").(string); ok && entry.Method == "event.save" {
+			entry.PayloadHash = &hash
+			if h.cfg.Audit.RawRetention > 0 && entry.ClubId != nil && body != nil {
+				raw = body
+			}
+		}
+
+		h.auditEnqueue(auditJob{entry: entry, raw: raw})
+		return nil
+	}
+}
+
+// Запись журнала в очереди. raw - исходное тело event.save или nil
+type auditJob struct {
+	entry ReplicationAuditEntry
+	raw   []byte
+}
+
+/*
+Постановка записи в очередь. Очередь ограничена числом записей (AUDIT_QUEUE) и объемом тел
+(AUDIT_QUEUE_BYTES): если БД или хранилище не успевают, запись отбрасывается, а тело, не влезающее
+в объем, не сохраняется. Отброшенные записи считаются и попадают в лог
+*/
+func (h *handler) auditEnqueue(job auditJob) {
+	size := int64(len(job.raw))
+	if size > 0 && atomic.AddInt64(h.auditQueued, size) > h.cfg.Audit.QueueBytes {
+		atomic.AddInt64(h.auditQueued, -size)
+		job.raw = nil
+		size = 0
+	}
+
+	select {
+	case h.audit <- job:
+		return
+	default:
+	}
+
+	if size > 0 {
+		atomic.AddInt64(h.auditQueued, -size)
+	}
+	if dropped := atomic.AddInt64(h.auditDropped, 1); dropped == 1 || dropped%1000 == 0 {
+		log.WithFields(log.Fields{
+			"proc":     "auditEnqueue",
+			"method":   job.entry.Method,
+			"board_id": job.entry.BoardId,
+			"dropped":  dropped,
+		}).Warn("Audit queue is full, entry dropped")
+	}
+}
+
+/*
+Запись журнала из очереди в AUDIT_WORKERS потоков. После отмены ctx (сервер уже остановлен)
+оставшиеся в очереди записи дописываются, затем функция возвращается
+*/
+func (h *handler) runAuditWriter(ctx context.Context) {
+	workers := h.cfg.Audit.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case job := <-h.audit:
+					h.auditRecord(job)
+					continue
+				case <-ctx.Done():
+				}
+
+				for {
+					select {
+					case job := <-h.audit:
+						h.auditRecord(job)
+					default:
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if dropped := atomic.LoadInt64(h.auditDropped); dropped > 0 {
+		log.WithFields(log.Fields{
+			"proc":    "runAuditWriter",
+			"dropped": dropped,
+		}).Warn("Audit entries dropped")
+	}
+}
+
+/*
+Исходные тела хранятся по SHA-256 самого тела, а не PayloadHash: выгрузки с одним содержимым,
+но разными revision или hash - разные тела, и повтор из журнала должен получить именно свое.
+Повторная отправка того же тела файл не дублирует
+*/
+func auditRawName(entry ReplicationAuditEntry, raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return storageName("audit", strconv.Itoa(int(*entry.ClubId)), *entry.BoardId, hex.EncodeToString(sum[:])+".json")
+}
+
+func (h *handler) auditRecord(job auditJob) {
+	ctx := context.Background()
+	entry, raw := job.entry, job.raw
+	defer atomic.AddInt64(h.auditQueued, -int64(len(raw)))
+
+	if raw != nil {
+		name := auditRawName(entry, raw)
+		_, err := h.storage.Stat(ctx, name)
+		if err == ErrStorageNotFound {
+			err = h.storage.Put(ctx, name, bytes.NewReader(raw), int64(len(raw)), echo.MIMEApplicationJSON)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"proc":  "auditRecord",
+				"name":  name,
+				"error": err,
+			}).Error("Storage error")
+		} else {
+			entry.RawName = &name
+		}
+	}
+
+	if _, err := h.DB.Exec(`select * from api_replication."replicationAuditAdd"($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);`,
+		entry.CallTime, entry.Method, entry.BoardId, entry.ClubId, entry.RequestId, entry.RequestSize,
+		entry.Status, entry.Outcome, entry.ErrorCode, entry.ErrorMessage, entry.DurationMs, entry.PayloadHash, entry.RawName); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "auditRecord",
+			"method":   entry.Method,
+			"board_id": entry.BoardId,
+			"error":    err,
+		}).Error("SQL error")
+	}
+}
+
+/*
+Удаление записей журнала старше AUDIT_RETENTION и исходных тел старше AUDIT_RAW_RETENTION.
+replicationAuditExpire возвращает файлы, на которые больше не ссылается ни одна запись
+*/
+func (h *handler) expireAudit(ctx context.Context) (released int, err error) {
+	var rows_before, raw_before *time.Time
+	now := time.Now()
+	if h.cfg.Audit.Retention > 0 {
+		before := now.Add(-h.cfg.Audit.Retention)
+		rows_before = &before
+	}
+	if h.cfg.Audit.RawRetention > 0 {
+		before := now.Add(-h.cfg.Audit.RawRetention)
+		raw_before = &before
+	}
+	if rows_before == nil && raw_before == nil {
+		return 0, nil
+	}
+
+	var names pq.StringArray
+	if err := h.DB.Get(&names, `select * from api_sight."replicationAuditExpire"($1, $2);`, rows_before, raw_before); err != nil {
+		return 0, errors.Wrap(err, "replicationAuditExpire SQL error")
+	}
+
+	for _, name := range names {
+		if err := h.storage.Delete(ctx, name); err != nil && err != ErrStorageNotFound {
+			log.WithFields(log.Fields{
+				"proc":  "expireAudit",
+				"name":  name,
+				"error": err,
+			}).Error("Delete error")
+			continue
+		}
+		released++
+	}
+	return released, nil
+}
+
+func (h *handler) runAuditRetention(ctx context.Context) {
+	if !h.cfg.Audit.Enabled || h.cfg.Audit.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.cfg.Audit.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		released, err := h.expireAudit(ctx)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"proc":  "runAuditRetention",
+				"error": err,
+			}).Error("Audit retention error")
+			continue
+		}
+		if released > 0 {
+			log.WithFields(log.Fields{
+				"proc":     "runAuditRetention",
+				"released": released,
+			}).Info("Expired audit bodies removed")
+		}
+	}
+}
+
+func (h *handler) auditEntry(id int64) (*ReplicationAuditEntry, error) {
+	var entry ReplicationAuditEntry
+	if err := h.DB.Get(&entry, `select * from api_sight."replicationAuditGet"($1);`, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrorNotFound
+		}
+		return nil, errors.Wrap(err, "replicationAuditGet SQL error")
+	}
+	entry.HasRaw = entry.RawName != nil
+	return &entry, nil
+}
+
+/*
+Журнал репликации от новых записей к старым. before_id - id последней записи предыдущей страницы,
+в ответе next_before_id для следующей страницы или null
+*/
+func (h *handler) adminAuditList(c jrpc.Context) error {
+	var params struct {
+		BoardId  *string    `json:"board_id"`
+		ClubId   *int32     `json:"club_id"`
+		From     *time.Time `json:"from"`
+		To       *time.Time `json:"to"`
+		Outcome  *string    `json:"outcome"`
+		Method   *string    `json:"method"`
+		BeforeId *int64     `json:"before_id"`
+		Limit    int        `json:"limit"`
+	}
+
+	// Параметры необязательны
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+
+	if params.Limit <= 0 {
+		params.Limit = listDefaultLimit
+	}
+	if params.Limit > listMaxLimit {
+		params.Limit = listMaxLimit
+	}
+
+	data := []ReplicationAuditEntry{}
+	if err := h.DB.Select(&data, `select * from api_sight."replicationAuditList"($1, $2, $3, $4, $5, $6, $7, $8);`,
+		params.BoardId, params.ClubId, params.From, params.To, params.Outcome, params.Method, params.BeforeId, params.Limit); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "adminAuditList",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	var next *int64
+	for i := range data {
+		data[i].HasRaw = data[i].RawName != nil
+	}
+	if len(data) == params.Limit {
+		next = &data[len(data)-1].Id
+	}
+
+	return c.Result(map[string]interface{}{
+		"items":          data,
+		"next_before_id": next,
+	})
+}
+
+// Исходное тело event.save из журнала
+func (h *handler) adminGetAuditRaw(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	entry, err := h.auditEntry(id)
+	if err == ErrorNotFound || (err == nil && entry.RawName == nil) {
+		return echo.NewHTTPError(http.StatusNotFound, "raw body not found")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return h.serveStorageFile(c, *entry.RawName, echo.MIMEApplicationJSON, "")
+}
+
+/*
+Повтор event.save из журнала от имени той же платы. Действуют те же правила ревизий:
+уже сохраненная выгрузка вернет duplicate, выгрузка по устаревшей ревизии - конфликт
+*/
+func (h *handler) adminAuditReplay(c jrpc.Context) error {
+	var id int64
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "adminAuditReplay Bind error")
+	}
+
+	entry, err := h.auditEntry(id)
+	if err != nil {
+		return err
+	}
+	if entry.RawName == nil || entry.ClubId == nil || entry.BoardId == nil {
+		return ErrorNotFound
+	}
+
+	f, _, err := h.storage.Get(c.EchoContext().Request().Context(), *entry.RawName)
+	if err == ErrStorageNotFound {
+		return ErrorNotFound
+	}
+	if err != nil {
+		return errors.Wrap(err, "adminAuditReplay storage error")
+	}
+	defer f.Close()
+
+	var call struct {
+		Params ReverseRequest `json:"params"`
+	}
+	if err := json.NewDecoder(f).Decode(&call); err != nil {
+		return errors.Wrap(err, "adminAuditReplay Unmarshal error")
+	}
+
+	hash, err := call.Params.contentHash()
+	if err != nil {
+		return errors.Wrap(err, "adminAuditReplay hash error")
+	}
+
+	result, err := h.storeCalculatedEvent(*entry.ClubId, *entry.BoardId, call.Params, hash)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"proc":     "adminAuditReplay",
+		"audit_id": id,
+		"board_id": *entry.BoardId,
+		"event_id": call.Params.Event.Id,
+	}).Info("event.save replayed")
+
+	return c.Result(result)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/golang-jwt/jwt"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Действующая пара secret/hw платы. getBoardCredentials возвращает текущую пару первой,
+за ней - прежние, срок перекрытия которых еще не истек
+*/
+type BoardCredential struct {
+	Secret  string         `db:"secret"`
+	ClubId  int32          `db:"club_id"`
+	Hw      sql.NullString `db:"hw"`
+	Revoked bool           `db:"revoked"`
+}
+
+// Учетные данные платы. Выдаются только при регистрации и ротации, повторно их получить нельзя
+type BoardSecrets struct {
+	BoardId       string     `json:"board_id"`
+	ClubId        int32      `json:"club_id"`
+	Secret        *string    `json:"secret,omitempty"`
+	Hw            *string    `json:"hw,omitempty"`
+	PreviousUntil *time.Time `json:"previous_until,omitempty"`
+}
+
+// Отзыв читается из БД при каждом запросе платы, поэтому действует сразу
+func (h *handler) boardCredentials(board_id string) ([]BoardCredential, error) {
+	data := []BoardCredential{}
+	if err := h.DB.Select(&data, `select * from api_replication."getBoardCredentials"($1);`, board_id); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func newBoardSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// Регистрация платы в клубе. hw=true выдает и аппаратный ключ для подписи запросов
+func (h *handler) adminBoardsCreate(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params struct {
+		BoardId string `json:"board_id"`
+		ClubId  int32  `json:"club_id"`
+		Hw      bool   `json:"hw"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminBoardsCreate Bind error")
+	}
+	if params.BoardId == "" || params.ClubId == 0 {
+		return ErrorInvalidParams
+	}
+
+	data := BoardSecrets{BoardId: params.BoardId, ClubId: params.ClubId}
+	secret, err := newBoardSecret()
+	if err != nil {
+		return errors.Wrap(err, "adminBoardsCreate rand error")
+	}
+	data.Secret = &secret
+	if params.Hw {
+		hw, err := newBoardSecret()
+		if err != nil {
+			return errors.Wrap(err, "adminBoardsCreate rand error")
+		}
+		data.Hw = &hw
+	}
+
+	var created bool
+	if err := h.DB.Get(&created, `select * from api_sight."boardsCreate"($1, $2, $3, $4, $5);`,
+		params.BoardId, params.ClubId, data.Secret, data.Hw, claims.ID); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "adminBoardsCreate",
+			"board_id": params.BoardId,
+			"error":    err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+	if !created {
+		return ErrorIsUsed
+	}
+
+	log.WithFields(log.Fields{
+		"proc":     "adminBoardsCreate",
+		"board_id": params.BoardId,
+		"club_id":  params.ClubId,
+		"user_id":  claims.ID,
+	}).Info("Board registered")
+
+	return c.Result(data)
+}
+
+/*
+Ротация secret и/или hw. Прежняя пара действует еще overlap секунд (по умолчанию BOARDS_ROTATE_OVERLAP),
+чтобы плата успела получить новые данные. overlap=0 отключает прежнюю пару сразу
+*/
+func (h *handler) adminBoardsRotate(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params struct {
+		BoardId string `json:"board_id"`
+		Secret  bool   `json:"secret"`
+		Hw      bool   `json:"hw"`
+		Overlap *int64 `json:"overlap"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminBoardsRotate Bind error")
+	}
+	if !params.Secret && !params.Hw {
+		return ErrorInvalidParams
+	}
+
+	overlap := h.cfg.Boards.RotateOverlap
+	if params.Overlap != nil {
+		if *params.Overlap < 0 {
+			return ErrorInvalidParams
+		}
+		overlap = time.Duration(*params.Overlap) * time.Second
+	}
+	previous_until := time.Now().Add(overlap)
+
+	data := BoardSecrets{BoardId: params.BoardId, PreviousUntil: &previous_until}
+	if params.Secret {
+		secret, err := newBoardSecret()
+		if err != nil {
+			return errors.Wrap(err, "adminBoardsRotate rand error")
+		}
+		data.Secret = &secret
+	}
+	if params.Hw {
+		hw, err := newBoardSecret()
+		if err != nil {
+			return errors.Wrap(err, "adminBoardsRotate rand error")
+		}
+		data.Hw = &hw
+	}
+
+	// nil оставляет прежнее значение в новой паре
+	err := h.DB.Get(&data.ClubId, `select * from api_sight."boardsRotate"($1, $2, $3, $4, $5);`,
+		params.BoardId, data.Secret, data.Hw, previous_until, claims.ID)
+	if err == sql.ErrNoRows {
+		return ErrorNotFound
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "adminBoardsRotate",
+			"board_id": params.BoardId,
+			"error":    err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	log.WithFields(log.Fields{
+		"proc":           "adminBoardsRotate",
+		"board_id":       params.BoardId,
+		"secret":         params.Secret,
+		"hw":             params.Hw,
+		"previous_until": previous_until,
+		"user_id":        claims.ID,
+	}).Info("Board credentials rotated")
+
+	return c.Result(data)
+}
+
+// Отзыв платы (например, украденной). Все ее пары secret/hw перестают действовать со следующего запроса
+func (h *handler) adminBoardsRevoke(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params struct {
+		BoardId string  `json:"board_id"`
+		Reason  *string `json:"reason"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminBoardsRevoke Bind error")
+	}
+
+	var found bool
+	if err := h.DB.Get(&found, `select * from api_sight."boardsRevoke"($1, $2, $3);`, params.BoardId, params.Reason, claims.ID); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "adminBoardsRevoke",
+			"board_id": params.BoardId,
+			"error":    err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+	if !found {
+		return ErrorNotFound
+	}
+
+	log.WithFields(log.Fields{
+		"proc":     "adminBoardsRevoke",
+		"board_id": params.BoardId,
+		"reason":   params.Reason,
+		"user_id":  claims.ID,
+	}).Warn("Board revoked")
+
+	return c.Result(true)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type cfgBoards struct {
+	// Плата, от которой не было запросов дольше этого срока, помечается как молчащая
+	SilentAfter time.Duration `env:"BOARDS_SILENT_AFTER" envDefault:"2h"`
+	// Не чаще одного обновления last_seen за интервал на плату, ping пишется всегда
+	SeenInterval time.Duration `env:"BOARDS_SEEN_INTERVAL" envDefault:"1m"`
+	// Сколько действует прежняя пара secret/hw после ротации
+	RotateOverlap time.Duration `env:"BOARDS_ROTATE_OVERLAP" envDefault:"24h"`
+}
+
+// Версия ПО платы, если она передана в заголовке запроса
+const headerBoardVersion = "X-Board-Version"
+
+// Состояние платы в реестре
+type BoardInfo struct {
+	BoardId        string     `json:"board_id" db:"board_id"`
+	ClubId         int32      `json:"club_id" db:"club_id"`
+	LastSeen       *time.Time `json:"last_seen" db:"last_seen"`
+	LastPing       *time.Time `json:"last_ping" db:"last_ping"`
+	IP             *string    `json:"ip" db:"ip"`
+	Version        *string    `json:"version" db:"version"`
+	FreeDisk       *int64     `json:"free_disk" db:"free_disk"`
+	PendingUploads *int32     `json:"pending_uploads" db:"pending_uploads"`
+	LastEventSave  *time.Time `json:"last_event_save" db:"last_event_save"`
+	LastEventId    *string    `json:"last_event_id" db:"last_event_id"`
+	Silent         bool       `json:"silent" db:"-"`
+}
+
+// Время последней записи last_seen по платам
+var boardsSeen sync.Map
+
+/*
+Отмечает в реестре каждый запрос платы после проверки BasicAuth: время, IP и версию ПО.
+Запись в БД не чаще BOARDS_SEEN_INTERVAL, ошибки реестра не мешают репликации
+*/
+func (h *handler) BoardHeartbeat(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		board_id, ok := c.Get("board_id").(string)
+		if !ok {
+			return next(c)
+		}
+
+		now := time.Now()
+		if last, ok := boardsSeen.Load(board_id); !ok || now.Sub(last.(time.Time)) >= h.cfg.Boards.SeenInterval {
+			boardsSeen.Store(board_id, now)
+			h.boardSeen(c, nil, nil)
+		}
+
+		return next(c)
+	}
+}
+
+func boardVersion(c echo.Context) *string {
+	if version := c.Request().Header.Get(headerBoardVersion); version != "" {
+		return &version
+	}
+	return nil
+}
+
+/*
+Обновляет реестр. free_disk и pending_uploads передаются только в ping,
+в остальных запросах nil оставляет прежние значения
+*/
+func (h *handler) boardSeen(c echo.Context, free_disk *int64, pending_uploads *int32) {
+	club_id := c.Get("club_id").(int32)
+	board_id := c.Get("board_id").(string)
+
+	if _, err := h.DB.Exec(`select * from api_replication."boardsSeen"($1, $2, $3, $4, $5, $6);`,
+		club_id, board_id, c.RealIP(), boardVersion(c), free_disk, pending_uploads); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "boardSeen",
+			"board_id": board_id,
+			"error":    err,
+		}).Error("SQL error")
+	}
+}
+
+// Отмечает успешное сохранение тренировки платой
+func (h *handler) boardEventSaved(club_id int32, board_id string, event_id string) {
+	if _, err := h.DB.Exec(`select * from api_replication."boardsEventSaved"($1, $2, $3);`, club_id, board_id, event_id); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "boardEventSaved",
+			"board_id": board_id,
+			"event_id": event_id,
+			"error":    err,
+		}).Error("SQL error")
+	}
+}
+
+func (h *handler) boardsList(club_id *int32) ([]BoardInfo, error) {
+	data := []BoardInfo{}
+	if err := h.DB.Select(&data, `select * from api_sight."boardsList"($1);`, club_id); err != nil {
+		return nil, err
+	}
+
+	silent_since := time.Now().Add(-h.cfg.Boards.SilentAfter)
+	for i := range data {
+		data[i].Silent = data[i].LastSeen == nil || data[i].LastSeen.Before(silent_since)
+	}
+	return data, nil
+}
+
+// Платы клуба и их состояние
+func (h *handler) clubBoardsList(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	club_id, err := claimsClubID(claims)
+	if err != nil {
+		return err
+	}
+
+	data, err := h.boardsList(club_id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "clubBoardsList",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Платы всех клубов. silent=true оставляет только молчащие
+func (h *handler) adminBoardsList(c jrpc.Context) error {
+	var params struct {
+		ClubId *int32 `json:"club_id"`
+		Silent bool   `json:"silent"`
+	}
+
+	// Параметры необязательны
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+
+	data, err := h.boardsList(params.ClubId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "adminBoardsList",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	if params.Silent {
+		silent := []BoardInfo{}
+		for _, board := range data {
+			if board.Silent {
+				silent = append(silent, board)
+			}
+		}
+		data = silent
+	}
+
+	return c.Result(data)
+}
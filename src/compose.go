@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Ревизия compose и ее контрольная сумма для платы
+const (
+	headerComposeRevision = "X-Compose-Revision"
+	headerComposeChecksum = "X-Compose-Checksum"
+)
+
+/*
+Ревизия шаблона docker-compose.yml. Цель и постепенный выпуск - как у выпусков ПО (ReleaseInfo).
+Variables - значения по умолчанию для шаблона, их переопределяют переменные клуба и платы
+*/
+type ComposeRevision struct {
+	Id             int64            `json:"id" db:"id"`
+	Template       string           `json:"template" db:"template"`
+	Variables      ComposeVariables `json:"variables" db:"variables"`
+	ClubId         *int32           `json:"club_id" db:"club_id"`
+	BoardId        *string          `json:"board_id" db:"board_id"`
+	RolloutPercent int16            `json:"rollout_percent" db:"rollout_percent"`
+	Withdrawn      bool             `json:"withdrawn" db:"withdrawn"`
+	Comment        *string          `json:"comment" db:"comment"`
+	CreateTime     time.Time        `json:"create_time" db:"create_time"`
+	UserId         string           `json:"user_id" db:"user_id"`
+}
+
+// Какую ревизию compose плата получила последней
+type ComposeFetch struct {
+	BoardId    string    `json:"board_id" db:"board_id"`
+	ClubId     int32     `json:"club_id" db:"club_id"`
+	RevisionId int64     `json:"revision_id" db:"revision_id"`
+	Checksum   string    `json:"checksum" db:"checksum"`
+	FetchTime  time.Time `json:"fetch_time" db:"fetch_time"`
+}
+
+// Переменные шаблона (теги образов, окружение и т.п.), в БД - jsonb
+type ComposeVariables map[string]string
+
+func (v *ComposeVariables) Scan(src interface{}) error {
+	var data []byte
+	switch src := src.(type) {
+	case nil:
+		*v = ComposeVariables{}
+		return nil
+	case []byte:
+		data = src
+	case string:
+		data = []byte(src)
+	default:
+		return errors.New("ComposeVariables: unsupported type")
+	}
+	vars := ComposeVariables{}
+	if err := json.Unmarshal(data, &vars); err != nil {
+		return err
+	}
+	*v = vars
+	return nil
+}
+
+/*
+Имя переменной, значение которой нельзя подставить в шаблон как есть, или "".
+Значения подставляются в YAML без экранирования, поэтому перевод строки или другой
+управляющий символ позволил бы дописать в compose произвольные ключи
+*/
+func (v ComposeVariables) invalid() string {
+	for name, value := range v {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool {
+			return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		}) >= 0 {
+			return name
+		}
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+func parseComposeTemplate(text string) (*template.Template, error) {
+	return template.New("docker-compose.yml").Option("missingkey=error").Parse(text)
+}
+
+/*
+Переменные для платы: значения ревизии, затем общие, клуба и платы (composeVariables
+возвращает их от общих к частным), и встроенные club_id, board_id, revision, которые переопределить нельзя
+*/
+func (h *handler) composeBoardVariables(revision ComposeRevision, club_id int32, board_id string) (ComposeVariables, error) {
+	vars := ComposeVariables{}
+	for k, v := range revision.Variables {
+		vars[k] = v
+	}
+
+	var scopes []ComposeVariables
+	if err := h.DB.Select(&scopes, `select * from api_replication."composeVariables"($1, $2);`, club_id, board_id); err != nil {
+		return nil, errors.Wrap(err, "composeVariables SQL error")
+	}
+	for _, scope := range scopes {
+		for k, v := range scope {
+			vars[k] = v
+		}
+	}
+
+	vars["club_id"] = strconv.Itoa(int(club_id))
+	vars["board_id"] = board_id
+	vars["revision"] = strconv.FormatInt(revision.Id, 10)
+	return vars, nil
+}
+
+// Шаблон ревизии, отрисованный для платы, и SHA-256 результата
+func (h *handler) renderCompose(revision ComposeRevision, club_id int32, board_id string) ([]byte, string, error) {
+	tmpl, err := parseComposeTemplate(revision.Template)
+	if err != nil {
+		return nil, "", err
+	}
+	vars, err := h.composeBoardVariables(revision, club_id, board_id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, vars); err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(out.Bytes())
+	return out.Bytes(), hex.EncodeToString(sum[:]), nil
+}
+
+// Ревизия compose для платы: как boardTargetRelease, от более точной цели и новой к старой
+func (h *handler) boardTargetCompose(club_id int32, board_id string) (*ComposeRevision, error) {
+	var candidates []ComposeRevision
+	if err := h.DB.Select(&candidates, `select * from api_replication."composeCandidates"($1, $2);`, club_id, board_id); err != nil {
+		return nil, errors.Wrap(err, "composeCandidates SQL error")
+	}
+
+	for i := range candidates {
+		rev := candidates[i]
+		if rolloutIncludes(board_id, "compose/"+strconv.FormatInt(rev.Id, 10), rev.BoardId != nil, rev.RolloutPercent) {
+			return &candidates[i], nil
+		}
+	}
+	return nil, nil
+}
+
+/*
+docker-compose.yml для платы. Если для нее есть ревизия шаблона, он отрисовывается с переменными платы,
+в заголовках передаются ревизия и контрольная сумма, а получение записывается в composeFetched.
+Иначе, как раньше, отдается первый найденный файл update/<club>/<board>, update/<club> или update/
+*/
+func (h *handler) replicationGetCompose(c echo.Context) error {
+	club_id := c.Get("club_id").(int32)
+	board_id := c.Get("board_id").(string)
+
+	revision, err := h.boardTargetCompose(club_id, board_id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "replicationGetCompose",
+			"board_id": board_id,
+			"error":    err,
+		}).Error("SQL error")
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if revision == nil {
+		candidates := []string{
+			storageName("update", strconv.Itoa(int(club_id)), board_id, "docker-compose.yml"),
+			storageName("update", strconv.Itoa(int(club_id)), "docker-compose.yml"),
+			storageName("update", "docker-compose.yml"),
+		}
+
+		for _, composePath := range candidates {
+			if _, err := h.storage.Stat(c.Request().Context(), composePath); err == nil {
+				return h.serveStorageFile(c, composePath, "application/yml", "")
+			}
+		}
+
+		return echo.NewHTTPError(http.StatusNotFound, "file not found")
+	}
+
+	body, checksum, err := h.renderCompose(*revision, club_id, board_id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":        "replicationGetCompose",
+			"board_id":    board_id,
+			"revision_id": revision.Id,
+			"error":       err,
+		}).Error("Compose render error")
+		return echo.NewHTTPError(http.StatusInternalServerError, "compose render error")
+	}
+
+	if _, err := h.DB.Exec(`select * from api_replication."composeFetched"($1, $2, $3, $4);`, club_id, board_id, revision.Id, checksum); err != nil {
+		log.WithFields(log.Fields{
+			"proc":        "replicationGetCompose",
+			"board_id":    board_id,
+			"revision_id": revision.Id,
+			"error":       err,
+		}).Error("SQL error")
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "application/yml")
+	header.Set("Cache-Control", h.cfg.FilesCache)
+	header.Set("ETag", `"`+checksum+`"`)
+	header.Set(headerComposeRevision, strconv.FormatInt(revision.Id, 10))
+	header.Set(headerComposeChecksum, "sha-256="+checksum)
+
+	// Без Last-Modified: содержимое меняется и при смене переменных, сверка только по ETag
+	http.ServeContent(c.Response(), c.Request(), "", time.Time{}, bytes.NewReader(body))
+	return nil
+}
+
+func (h *handler) adminComposeList(c jrpc.Context) error {
+	var params struct {
+		ClubId *int32 `json:"club_id"`
+	}
+
+	// Параметры необязательны
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+
+	data := []ComposeRevision{}
+	if err := h.DB.Select(&data, `select * from api_sight."composeList"($1);`, params.ClubId); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "adminComposeList",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Новая ревизия шаблона. Шаблон проверяется при сохранении, ошибка возвращается в data
+func (h *handler) adminComposeCreate(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params ComposeRevision
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminComposeCreate Bind error")
+	}
+
+	if params.Template == "" || params.RolloutPercent < 0 || params.RolloutPercent > 100 {
+		return ErrorInvalidParams
+	}
+	if _, err := parseComposeTemplate(params.Template); err != nil {
+		return jrpc.NewError(400, "Некорректный шаблон", err.Error())
+	}
+	if params.Variables == nil {
+		params.Variables = ComposeVariables{}
+	}
+	if name := params.Variables.invalid(); name != "" {
+		return jrpc.NewError(400, "Недопустимая переменная", name)
+	}
+	variables, err := json.Marshal(params.Variables)
+	if err != nil {
+		return errors.Wrap(err, "adminComposeCreate Marshal error")
+	}
+
+	var data ComposeRevision
+	if err := h.DB.Get(&data, `select * from api_sight."composeAdd"($1, $2, $3, $4, $5, $6, $7);`,
+		params.Template, string(variables), params.ClubId, params.BoardId, params.RolloutPercent, params.Comment, claims.ID); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "adminComposeCreate",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Изменение доли плат постепенного выпуска ревизии
+func (h *handler) adminComposeRollout(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params struct {
+		Id             int64 `json:"id"`
+		RolloutPercent int16 `json:"rollout_percent"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminComposeRollout Bind error")
+	}
+	if params.RolloutPercent < 0 || params.RolloutPercent > 100 {
+		return ErrorInvalidParams
+	}
+
+	var data ComposeRevision
+	if err := h.DB.Get(&data, `select * from api_sight."composeSetRollout"($1, $2, $3);`, params.Id, params.RolloutPercent, claims.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrorNotFound
+		}
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Отзыв ревизии. Платы получат предыдущую действующую ревизию
+func (h *handler) adminComposeWithdraw(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var id int64
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "adminComposeWithdraw Bind error")
+	}
+
+	var data ComposeRevision
+	if err := h.DB.Get(&data, `select * from api_sight."composeWithdraw"($1, $2);`, id, claims.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrorNotFound
+		}
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Последние полученные платами ревизии, с фильтром по клубу или ревизии
+func (h *handler) adminComposeFetches(c jrpc.Context) error {
+	var params struct {
+		ClubId     *int32 `json:"club_id"`
+		RevisionId *int64 `json:"revision_id"`
+	}
+
+	// Параметры необязательны
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+
+	data := []ComposeFetch{}
+	if err := h.DB.Select(&data, `select * from api_sight."composeFetches"($1, $2);`, params.ClubId, params.RevisionId); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "adminComposeFetches",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+/*
+Переменные шаблона: общие (без club_id и board_id), клуба или платы.
+Пустое значение удаляет переменную
+*/
+func (h *handler) adminComposeVariablesSet(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params struct {
+		ClubId    *int32           `json:"club_id"`
+		BoardId   *string          `json:"board_id"`
+		Variables ComposeVariables `json:"variables"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminComposeVariablesSet Bind error")
+	}
+	if params.ClubId != nil && params.BoardId != nil {
+		return ErrorInvalidParams
+	}
+	for _, name := range []string{"club_id", "board_id", "revision"} {
+		if _, ok := params.Variables[name]; ok {
+			return ErrorInvalidParams
+		}
+	}
+	if name := params.Variables.invalid(); name != "" {
+		return jrpc.NewError(400, "Недопустимая переменная", name)
+	}
+
+	variables, err := json.Marshal(params.Variables)
+	if err != nil {
+		return errors.Wrap(err, "adminComposeVariablesSet Marshal error")
+	}
+
+	var data ComposeVariables
+	if err := h.DB.Get(&data, `select * from api_sight."composeVariablesSet"($1, $2, $3, $4);`,
+		params.ClubId, params.BoardId, string(variables), claims.ID); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "adminComposeVariablesSet",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Шаблон ревизии, отрисованный для платы, без записи получения
+func (h *handler) adminComposePreview(c jrpc.Context) error {
+	var params struct {
+		Id      int64  `json:"id"`
+		ClubId  int32  `json:"club_id"`
+		BoardId string `json:"board_id"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminComposePreview Bind error")
+	}
+
+	var revision ComposeRevision
+	if err := h.DB.Get(&revision, `select * from api_sight."composeGet"($1);`, params.Id); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrorNotFound
+		}
+		return errors.Wrap(err, "SQL error")
+	}
+
+	body, checksum, err := h.renderCompose(revision, params.ClubId, params.BoardId)
+	if err != nil {
+		return jrpc.NewError(400, "Ошибка шаблона", err.Error())
+	}
+
+	return c.Result(map[string]interface{}{
+		"compose":  string(body),
+		"checksum": checksum,
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	queryReportGetPlayerData string = `select * from api_sight."reportGetPlayerData"($1, $2, $3);`
+
+	dashboardRecordsDays int = 365
+	dashboardAcuteDays   int = 7
+	dashboardChronicDays int = 28
+	dashboardRecentCount int = 5
+)
+
+// Строка кэша отчета игрока с датой начала тренировки
+type DBPlayerReportRecord struct {
+	DBReportRecord
+	EventStart time.Time `db:"event_start" json:"event_start"`
+}
+
+// Суммарная нагрузка игрока за период
+type DashboardLoad struct {
+	Days         int     `json:"days"`
+	EventCount   int     `json:"event_count"`
+	SumLength    float32 `json:"sum_length"`
+	SumLoad      int32   `json:"sum_load"`
+	Duration     int64   `json:"duration"`
+	Implodes     int64   `json:"implodes"`
+	AveragePulse int16   `json:"average_pulse"`
+	Energy       float32 `json:"energy"`
+}
+
+// Рекорд игрока и тренировка, на которой он установлен
+type DashboardRecord struct {
+	Value     float32         `json:"value"`
+	EventID   string          `json:"event_id"`
+	EventInfo json.RawMessage `json:"event_info"`
+}
+
+type DashboardEvent struct {
+	EventID      string          `json:"event_id"`
+	EventInfo    json.RawMessage `json:"event_info"`
+	EventStart   time.Time       `json:"event_start"`
+	SumLength    float32         `json:"sum_length"`
+	SumLoad      int32           `json:"sum_load"`
+	Duration     int64           `json:"duration"`
+	MaxSpeed     float32         `json:"max_speed"`
+	MaxPulse     int16           `json:"max_pulse"`
+	AveragePulse int16           `json:"average_pulse"`
+}
+
+type playerEventData struct {
+	ReportCalculatedRecord
+	Raw   ReportMinimalRecord
+	Event DashboardEvent
+}
+
+func dashboardLoad(events []playerEventData, days int, now time.Time) (load DashboardLoad) {
+	load.Days = days
+	since := now.AddDate(0, 0, -days)
+
+	// Суммирование начинается с пустой записи, чтобы не изменять массивы зон исходных тренировок
+	var merged ReportCalculatedRecord
+	for _, event := range events {
+		if event.Event.EventStart.Before(since) {
+			continue
+		}
+		merged.ReportMinimalRecord = MegreReportMinimalRecords(merged.ReportMinimalRecord, event.Raw)
+		merged.PlayerWeight = event.Raw.PlayerWeight
+		load.EventCount++
+	}
+
+	if load.EventCount == 0 {
+		return load
+	}
+
+	merged = MakeCalculatedParams(merged)
+	load.SumLength = merged.SumLength
+	load.SumLoad = merged.SumLoad
+	load.Duration = int64(merged.LpsSeconds)
+	load.Implodes = merged.Implodes
+	load.AveragePulse = merged.AveragePulse
+	load.Energy = merged.Energy
+	return load
+}
+
+func dashboardBest(events []playerEventData, value func(e playerEventData) float32) *DashboardRecord {
+	var best *DashboardRecord
+	for _, event := range events {
+		v := value(event)
+		if v <= 0 || (best != nil && v <= best.Value) {
+			continue
+		}
+		best = &DashboardRecord{Value: v, EventID: event.Event.EventID, EventInfo: event.Event.EventInfo}
+	}
+	return best
+}
+
+/*
+Сводка игрока для личного кабинета: нагрузка за последние 7 и 28 дней,
+соотношение острой и хронической нагрузки, личные рекорды за год и последние тренировки
+*/
+func (h *handler) myDashboard(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := int(claims.Data["club_id"].(float64))
+
+	player_id := claimsPlayerID(claims)
+	if player_id == nil {
+		return ErrorForbidden
+	}
+
+	now := time.Now()
+
+	var split_data []DBPlayerReportRecord
+	if err := h.DB.Select(&split_data, queryReportGetPlayerData, club_id, *player_id, now.AddDate(0, 0, -dashboardRecordsDays)); err != nil {
+		log.WithFields(log.Fields{
+			"proc":      "myDashboard",
+			"player_id": *player_id,
+			"error":     err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	var events []playerEventData
+	for _, element := range split_data {
+		var found bool = false
+		for idx, event := range events {
+			if event.Event.EventID == element.EventID {
+				found = true
+				events[idx].ReportMinimalRecord = MegreReportMinimalRecords(events[idx].ReportMinimalRecord, element.ReportMinimalRecord)
+			}
+		}
+
+		if !found {
+			var rec playerEventData
+			rec.ReportMinimalRecord = element.ReportMinimalRecord
+			rec.Event.EventID = element.EventID
+			rec.Event.EventInfo = element.EventInfo
+			rec.Event.EventStart = element.EventStart
+
+			events = append(events, rec)
+		}
+	}
+
+	for idx := range events {
+		events[idx].Raw = events[idx].ReportMinimalRecord
+		events[idx].ReportCalculatedRecord = MakeCalculatedParams(events[idx].ReportCalculatedRecord)
+		events[idx].Event.SumLength = events[idx].SumLength
+		events[idx].Event.SumLoad = events[idx].SumLoad
+		events[idx].Event.Duration = int64(events[idx].LpsSeconds)
+		events[idx].Event.MaxSpeed = events[idx].DopplerMaxSpeed
+		events[idx].Event.MaxPulse = events[idx].MaxPulse
+		events[idx].Event.AveragePulse = events[idx].AveragePulse
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Event.EventStart.After(events[j].Event.EventStart)
+	})
+
+	acute := dashboardLoad(events, dashboardAcuteDays, now)
+	chronic := dashboardLoad(events, dashboardChronicDays, now)
+
+	var acute_chronic float32
+	if chronic.SumLoad != 0 {
+		acute_chronic = (float32(acute.SumLoad) / float32(dashboardAcuteDays)) / (float32(chronic.SumLoad) / float32(dashboardChronicDays))
+	}
+
+	recent := make([]DashboardEvent, 0, dashboardRecentCount)
+	for idx := 0; idx < len(events) && idx < dashboardRecentCount; idx++ {
+		recent = append(recent, events[idx].Event)
+	}
+
+	return c.Result(map[string]interface{}{
+		"player_id":           *player_id,
+		"load_acute":          acute,
+		"load_chronic":        chronic,
+		"acute_chronic_ratio": acute_chronic,
+		"records": map[string]interface{}{
+			"max_speed":  dashboardBest(events, func(e playerEventData) float32 { return e.DopplerMaxSpeed }),
+			"max_pulse":  dashboardBest(events, func(e playerEventData) float32 { return float32(e.MaxPulse) }),
+			"sum_length": dashboardBest(events, func(e playerEventData) float32 { return e.SumLength }),
+			"sum_load":   dashboardBest(events, func(e playerEventData) float32 { return float32(e.SumLoad) }),
+		},
+		"recent_events": recent,
+	})
+}
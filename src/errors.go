@@ -5,6 +5,12 @@ import "github.com/mrFokin/jrpc"
 var (
 	ErrorForbidden        = jrpc.NewError(403, "Недостаточно прав", nil)
 	ErrorNotFound         = jrpc.NewError(404, "Объект не найден", nil)
+	ErrorInvalidParams    = jrpc.NewError(400, "Некорректные параметры", nil)
+	ErrorInvalidCursor    = jrpc.NewError(400, "Некорректный курсор", nil)
 	ErrorIsUsed           = jrpc.NewError(226, "Объект используется", nil)
 	ErrorSplitsOverlapped = jrpc.NewError(700, "Обнаружено пересечение сплитов или тренировок", nil)
+	ErrorPlayerActive     = jrpc.NewError(409, "Игрок активен. Перед удалением его нужно деактивировать", nil)
+	ErrorRecalcAlgorithm  = jrpc.NewError(404, "Алгоритм расчета не найден", nil)
+	ErrorRecalcNotReady   = jrpc.NewError(409, "Пересчет не завершен или уже применен", nil)
+	ErrorRecalcStale      = jrpc.NewError(409, "Тренировка изменена после пересчета, его нужно выполнить заново", nil)
 )
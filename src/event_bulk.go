@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type cfgEventSave struct {
+	// Пакетная запись строк тренировки. Включается после установки пакетных процедур в БД
+	Bulk bool `env:"EVENT_SAVE_BULK" envDefault:"false"`
+	// Строк в одном вызове пакетной процедуры
+	BatchRows int `env:"EVENT_SAVE_BATCH_ROWS" envDefault:"2000"`
+	// Предельный размер запроса к /replication (формат middleware.BodyLimit)
+	MaxRequest string `env:"EVENT_SAVE_MAX_REQUEST" envDefault:"64M"`
+	// Проверка выгрузки до записи: strict, warn или off (см. checkReverseRequest)
+	Validate string `env:"EVENT_SAVE_VALIDATE" envDefault:"strict"`
+}
+
+// Строки выгрузки для пакетной процедуры proc: n строк, chunk возвращает срез строк [lo, hi)
+type bulkRows struct {
+	proc  string
+	n     int
+	chunk func(lo, hi int) interface{}
+}
+
+// Датчики, сплиты, игроки сплитов и показатели тренировки в порядке записи
+func eventBulkRows(params ReverseRequest) []bulkRows {
+	return []bulkRows{
+		{"eventsSetPlayerSensorsBulk", len(params.EventSensors), func(lo, hi int) interface{} {
+			return params.EventSensors[lo:hi]
+		}},
+		{"splitsAddBulk", len(params.Splits), func(lo, hi int) interface{} {
+			return params.Splits[lo:hi]
+		}},
+		{"splitsPlayersAddBulk", len(params.SplitPlayers), func(lo, hi int) interface{} {
+			return params.SplitPlayers[lo:hi]
+		}},
+		{"splitsReportDataAddBulk", len(params.SplitReportData), func(lo, hi int) interface{} {
+			return params.SplitReportData[lo:hi]
+		}},
+	}
+}
+
+/*
+Разбивает строки на пакеты по batch строк (batch <= 0 - одним пакетом) и передает exec
+каждый пакет одним jsonb-массивом вместе с числом строк в нем
+*/
+func (rows bulkRows) batches(batch int, exec func(data []byte, count int) error) error {
+	if batch <= 0 {
+		batch = rows.n
+	}
+
+	for lo := 0; lo < rows.n; lo += batch {
+		hi := lo + batch
+		if hi > rows.n {
+			hi = rows.n
+		}
+
+		data, err := json.Marshal(rows.chunk(lo, hi))
+		if err != nil {
+			return errors.Wrap(err, rows.proc+" Marshal error")
+		}
+		if err := exec(data, hi-lo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Вызывает пакетную процедуру proc(club_id, rows jsonb) частями по BatchRows.
+Процедура разбирает массив через jsonb_to_recordset во временную таблицу и переносит строки
+одним запросом, поэтому на тренировку приходится несколько вызовов вместо вызова на каждую строку
+*/
+func (h *handler) bulkExec(TX *sqlx.Tx, club_id int32, rows bulkRows) error {
+	return rows.batches(h.cfg.EventSave.BatchRows, func(data []byte, count int) error {
+		if _, err := TX.Exec(`select * from api_replication."`+rows.proc+`"($1, $2);`, club_id, string(data)); err != nil {
+			log.WithFields(log.Fields{
+				"proc":  "saveCalculatedEvent",
+				"SQL":   rows.proc,
+				"rows":  count,
+				"error": err,
+			}).Error("SQL error")
+
+			if strings.Contains(err.Error(), "Splits overlapped") {
+				return ErrorSplitsOverlapped
+			}
+			return errors.Wrap(err, "SQL error")
+		}
+		return nil
+	})
+}
+
+// Датчики, сплиты, игроки сплитов и показатели тренировки пакетами
+func (h *handler) writeEventRowsBulk(TX *sqlx.Tx, club_id int32, params ReverseRequest) error {
+	for _, rows := range eventBulkRows(params) {
+		if err := h.bulkExec(TX, club_id, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
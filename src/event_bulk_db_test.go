@@ -0,0 +1,81 @@
+//go:build dbbench
+// +build dbbench
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+Запись выгрузки в БД по одной строке и пакетами с разным BatchRows:
+go test -tags dbbench -run XXX -bench WriteCalculatedEvent
+Нужна БД с процедурами api_replication: BENCH_DB - строка подключения lib/pq,
+BENCH_CLUB_ID - клуб, BENCH_PLAYERS - id игроков этого клуба через запятую, BENCH_TEAM_ID - команда клуба.
+Каждая запись выполняется в транзакции, которая затем откатывается
+*/
+func BenchmarkWriteCalculatedEvent(b *testing.B) {
+	dsn := os.Getenv("BENCH_DB")
+	if dsn == "" {
+		b.Skip("BENCH_DB is not set")
+	}
+
+	club_id, err := strconv.Atoi(os.Getenv("BENCH_CLUB_ID"))
+	if err != nil {
+		b.Fatal("BENCH_CLUB_ID: ", err)
+	}
+	team_id, err := strconv.Atoi(os.Getenv("BENCH_TEAM_ID"))
+	if err != nil {
+		b.Fatal("BENCH_TEAM_ID: ", err)
+	}
+	var players []int
+	for _, s := range strings.Split(os.Getenv("BENCH_PLAYERS"), ",") {
+		player_id, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			b.Fatal("BENCH_PLAYERS: ", err)
+		}
+		players = append(players, player_id)
+	}
+
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	params := bulkTestRequest(players, 400)
+	params.Event.TeamId = int32(team_id)
+
+	cases := []struct {
+		name  string
+		bulk  bool
+		batch int
+	}{
+		{"rows", false, 0},
+		{"bulk-500", true, 500},
+		{"bulk-2000", true, 2000},
+		{"bulk-5000", true, 5000},
+	}
+
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			h := &handler{DB: db, cfg: Config{EventSave: cfgEventSave{Bulk: tc.bulk, BatchRows: tc.batch}}}
+			for i := 0; i < b.N; i++ {
+				TX, err := db.Beginx()
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = h.writeCalculatedEvent(TX, int32(club_id), params)
+				TX.Rollback()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
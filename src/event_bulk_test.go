@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Id в формате uuid, как у тренировок и сплитов платы
+func bulkTestId(kind int, n int) string {
+	return fmt.Sprintf("00000000-0000-4000-%04x-%012x", 0x8000+kind, n)
+}
+
+// Выгрузка длинной тренировки: игроки players с датчиками, splits сплитов, у каждого сплита все игроки
+func bulkTestRequest(players []int, splits int) ReverseRequest {
+	var params ReverseRequest
+	params.Event.Id = bulkTestId(0, 1)
+	params.Event.Name = "bulk test"
+
+	start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	params.Event.StartTime = start
+	params.Event.StopTime = start.Add(time.Duration(splits) * time.Minute)
+
+	for i, player_id := range players {
+		params.EventSensors = append(params.EventSensors, EventSensorsRow{EventId: params.Event.Id, SensorId: 100 + i, PlayerID: player_id})
+	}
+
+	for s := 0; s < splits; s++ {
+		id := bulkTestId(1, s)
+		params.Splits = append(params.Splits, SplitRow{
+			Id:        id,
+			EventId:   params.Event.Id,
+			StartTime: start.Add(time.Duration(s) * time.Minute),
+			StopTime:  start.Add(time.Duration(s+1) * time.Minute),
+			Tags:      json.RawMessage(`["drill"]`),
+		})
+		for _, player_id := range players {
+			params.SplitPlayers = append(params.SplitPlayers, SplitPlayersRow{SplitId: id, PlayerID: player_id})
+			data, _ := json.Marshal(SplitReportData{SplitId: id, PlayerId: player_id, SumLength: 120.5, MaxSpeed: 7.2, CountPulse: 60, SumPulse: 9000})
+			params.SplitReportData = append(params.SplitReportData, data)
+		}
+	}
+	return params
+}
+
+// Игроки 1..n
+func bulkTestPlayers(n int) []int {
+	players := make([]int, n)
+	for i := range players {
+		players[i] = i + 1
+	}
+	return players
+}
+
+func TestBulkRowsBatches(t *testing.T) {
+	params := bulkTestRequest(bulkTestPlayers(3), 7)
+
+	tests := []struct {
+		name   string
+		batch  int
+		counts map[string][]int
+	}{
+		{"batch 5", 5, map[string][]int{
+			"eventsSetPlayerSensorsBulk": {3},
+			"splitsAddBulk":              {5, 2},
+			"splitsPlayersAddBulk":       {5, 5, 5, 5, 1},
+			"splitsReportDataAddBulk":    {5, 5, 5, 5, 1},
+		}},
+		{"batch equals rows", 7, map[string][]int{
+			"eventsSetPlayerSensorsBulk": {3},
+			"splitsAddBulk":              {7},
+			"splitsPlayersAddBulk":       {7, 7, 7},
+			"splitsReportDataAddBulk":    {7, 7, 7},
+		}},
+		{"single batch", 0, map[string][]int{
+			"eventsSetPlayerSensorsBulk": {3},
+			"splitsAddBulk":              {7},
+			"splitsPlayersAddBulk":       {21},
+			"splitsReportDataAddBulk":    {21},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, rows := range eventBulkRows(params) {
+				var counts []int
+				total := 0
+				err := rows.batches(tt.batch, func(data []byte, count int) error {
+					var items []json.RawMessage
+					if err := json.Unmarshal(data, &items); err != nil {
+						return err
+					}
+					if len(items) != count {
+						t.Errorf("%s: %d rows in batch, count %d", rows.proc, len(items), count)
+					}
+					counts = append(counts, count)
+					total += count
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				want := tt.counts[rows.proc]
+				if len(counts) != len(want) {
+					t.Fatalf("%s: batches %v, want %v", rows.proc, counts, want)
+				}
+				for i := range want {
+					if counts[i] != want[i] {
+						t.Fatalf("%s: batches %v, want %v", rows.proc, counts, want)
+					}
+				}
+				if total != rows.n {
+					t.Errorf("%s: %d rows in batches, want %d", rows.proc, total, rows.n)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkRowsEmpty(t *testing.T) {
+	for _, rows := range eventBulkRows(ReverseRequest{}) {
+		if err := rows.batches(2000, func([]byte, int) error {
+			t.Errorf("%s: batch for empty rows", rows.proc)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+/*
+Подготовка пакетов выгрузки 30 игроков на 400 сплитов (12 000 строк игроков и показателей):
+только разбиение по BatchRows и сериализация, без БД. Запись в БД сравнивает
+BenchmarkWriteCalculatedEvent (event_bulk_db_test.go, тег dbbench)
+*/
+func BenchmarkEventBulkRowsMarshal(b *testing.B) {
+	params := bulkTestRequest(bulkTestPlayers(30), 400)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var size int64
+		for _, rows := range eventBulkRows(params) {
+			if err := rows.batches(2000, func(data []byte, count int) error {
+				size += int64(len(data))
+				return nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.SetBytes(size)
+	}
+}
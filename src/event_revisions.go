@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/golang-jwt/jwt"
+	"github.com/jmoiron/sqlx"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Ревизия данных тренировки: выгрузка платы или откат администратором
+type EventRevision struct {
+	EventId  string    `json:"event_id" db:"event_id"`
+	Revision int64     `json:"revision" db:"revision"`
+	Hash     string    `json:"hash" db:"hash"`
+	BoardId  *string   `json:"board_id" db:"board_id"`
+	UserId   *string   `json:"user_id" db:"user_id"`
+	SaveTime time.Time `json:"save_time" db:"save_time"`
+}
+
+type EventSaveResult struct {
+	Revision  int64  `json:"revision"`
+	Hash      string `json:"hash"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+// Отличия выгрузки от сохраненной ревизии. Игроки и показатели сплитов - в виде "split_id/player_id"
+type EventSaveDiff struct {
+	Event               []string `json:"event"`
+	SplitsAdded         []string `json:"splits_added"`
+	SplitsRemoved       []string `json:"splits_removed"`
+	SplitsChanged       []string `json:"splits_changed"`
+	SplitPlayersAdded   []string `json:"split_players_added"`
+	SplitPlayersRemoved []string `json:"split_players_removed"`
+	ReportDataChanged   []string `json:"report_data_changed"`
+}
+
+// Содержимое выгрузки без ревизии и хэша, в этом виде оно хранится и хэшируется
+func (p ReverseRequest) payload() ([]byte, error) {
+	p.Revision = nil
+	p.Hash = nil
+	return json.Marshal(p)
+}
+
+/*
+SHA-256 содержимого выгрузки в том виде, в каком его сериализует сервер. Плата не может
+воспроизвести эти байты, поэтому хэш платы только сверяется (checkHash), а в ответе на event.save
+плата получает хэш сервера и дальше использует его
+*/
+func (p ReverseRequest) contentHash() (string, error) {
+	payload, err := p.payload()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Хэш, переданный платой, - справочный: расхождение с хэшем сервера только пишется в лог
+func (p ReverseRequest) checkHash(board_id string, hash string) {
+	if p.Hash == nil || *p.Hash == "" || strings.EqualFold(*p.Hash, hash) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"proc":        "checkHash",
+		"board_id":    board_id,
+		"event_id":    p.Event.Id,
+		"board_hash":  *p.Hash,
+		"server_hash": hash,
+	}).Debug("Board hash differs from server hash")
+}
+
+// Платы без поддержки ревизий получают прежний ответ true
+func (p ReverseRequest) saveResult(revision int64, hash string, duplicate bool) interface{} {
+	if p.Revision == nil && p.Hash == nil {
+		return true
+	}
+	return EventSaveResult{Revision: revision, Hash: hash, Duplicate: duplicate}
+}
+
+/*
+Текущая ревизия тренировки, nil для новой. До конца транзакции берется advisory-блокировка
+по id тренировки, поэтому параллельные выгрузки одной тренировки выполняются по очереди.
+Блокировка строки ревизии не подходит: у новой тренировки ее еще нет
+*/
+func eventRevisionCurrent(TX *sqlx.Tx, club_id int32, event_id string) (*EventRevision, error) {
+	if _, err := TX.Exec(`select pg_advisory_xact_lock(hashtext($1));`, event_id); err != nil {
+		return nil, errors.Wrap(err, "pg_advisory_xact_lock SQL error")
+	}
+
+	var revision EventRevision
+	err := TX.Get(&revision, `select * from api_replication."eventRevisionsCurrent"($1, $2);`, club_id, event_id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "eventRevisionsCurrent SQL error")
+	}
+	return &revision, nil
+}
+
+func eventRevisionPayload(TX *sqlx.Tx, club_id int32, event_id string, revision int64) (payload ReverseRequest, err error) {
+	var data json.RawMessage
+	err = TX.Get(&data, `select * from api_replication."eventRevisionsPayload"($1, $2, $3);`, club_id, event_id, revision)
+	if err == sql.ErrNoRows || (err == nil && data == nil) {
+		return payload, ErrorNotFound
+	}
+	if err != nil {
+		return payload, errors.Wrap(err, "eventRevisionsPayload SQL error")
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return payload, errors.Wrap(err, "eventRevisionsPayload Unmarshal error")
+	}
+	return payload, nil
+}
+
+func eventRevisionAdd(TX *sqlx.Tx, club_id int32, params ReverseRequest, revision int64, hash string, board_id *string, user_id *string) error {
+	payload, err := params.payload()
+	if err != nil {
+		return errors.Wrap(err, "eventRevisionAdd Marshal error")
+	}
+
+	if _, err := TX.Exec(`select * from api_replication."eventRevisionsAdd"($1, $2, $3, $4, $5, $6, $7);`,
+		club_id, params.Event.Id, revision, hash, board_id, user_id, string(payload)); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "eventRevisionAdd",
+			"event_id": params.Event.Id,
+			"revision": revision,
+			"error":    err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+	return nil
+}
+
+/*
+Выгрузка без ревизии (старая плата) заменяет ревизию другой платы, отката или пересчета.
+Отклонить ее нельзя - плата не умеет обрабатывать конфликт, поэтому замена записывается в журнал конфликтов
+*/
+func eventSaveOverwriteLog(TX *sqlx.Tx, club_id int32, board_id string, current *EventRevision, hash string, diff EventSaveDiff) error {
+	js_diff, err := json.Marshal(diff)
+	if err != nil {
+		return errors.Wrap(err, "eventSaveOverwriteLog Marshal error")
+	}
+
+	if _, err := TX.Exec(`select * from api_replication."eventSaveConflictsAdd"($1, $2, $3, $4, $5, $6);`,
+		club_id, current.EventId, current.Revision, board_id, hash, string(js_diff)); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "eventSaveOverwriteLog",
+			"event_id": current.EventId,
+			"error":    err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	log.WithFields(log.Fields{
+		"proc":          "eventSaveOverwriteLog",
+		"event_id":      current.EventId,
+		"revision":      current.Revision,
+		"board_id":      board_id,
+		"prev_board_id": current.BoardId,
+		"prev_user_id":  current.UserId,
+	}).Warn("Legacy event.save overwrote another revision")
+	return nil
+}
+
+// Ревизия записана не этой платой: другой платой, откатом или пересчетом
+func (r *EventRevision) foreign(board_id string) bool {
+	return r.BoardId == nil || *r.BoardId != board_id
+}
+
+func eventSaveConflict(current *EventRevision, base int64, diff EventSaveDiff) error {
+	return jrpc.NewError(409, "Тренировка уже изменена другой выгрузкой", map[string]interface{}{
+		"current_revision": current.Revision,
+		"base_revision":    base,
+		"board_id":         current.BoardId,
+		"save_time":        current.SaveTime,
+		"diff":             diff,
+	})
+}
+
+func splitPlayerKey(split_id string, player_id int) string {
+	return split_id + "/" + strconv.Itoa(player_id)
+}
+
+func reportDataByKey(rows []json.RawMessage) map[string][]byte {
+	data := map[string][]byte{}
+	for _, row := range rows {
+		var rec SplitReportData
+		if err := json.Unmarshal(row, &rec); err != nil {
+			continue
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, row); err != nil {
+			continue
+		}
+		data[splitPlayerKey(rec.SplitId, rec.PlayerId)] = compact.Bytes()
+	}
+	return data
+}
+
+// Что изменится, если применить выгрузку next поверх prev
+func reverseRequestDiff(prev, next ReverseRequest) EventSaveDiff {
+	diff := EventSaveDiff{
+		Event:               []string{},
+		SplitsAdded:         []string{},
+		SplitsRemoved:       []string{},
+		SplitsChanged:       []string{},
+		SplitPlayersAdded:   []string{},
+		SplitPlayersRemoved: []string{},
+		ReportDataChanged:   []string{},
+	}
+
+	if prev.Event.Name != next.Event.Name {
+		diff.Event = append(diff.Event, "name")
+	}
+	if prev.Event.TeamId != next.Event.TeamId {
+		diff.Event = append(diff.Event, "team_id")
+	}
+	if !prev.Event.StartTime.Equal(next.Event.StartTime) {
+		diff.Event = append(diff.Event, "start_time")
+	}
+	if !prev.Event.StopTime.Equal(next.Event.StopTime) {
+		diff.Event = append(diff.Event, "stop_time")
+	}
+
+	prev_splits := map[string]SplitRow{}
+	for _, split := range prev.Splits {
+		prev_splits[split.Id] = split
+	}
+	next_splits := map[string]bool{}
+	for _, split := range next.Splits {
+		next_splits[split.Id] = true
+		old, ok := prev_splits[split.Id]
+		switch {
+		case !ok:
+			diff.SplitsAdded = append(diff.SplitsAdded, split.Id)
+		case !old.StartTime.Equal(split.StartTime) || !old.StopTime.Equal(split.StopTime) || !bytes.Equal(old.Tags, split.Tags):
+			diff.SplitsChanged = append(diff.SplitsChanged, split.Id)
+		}
+	}
+	for _, split := range prev.Splits {
+		if !next_splits[split.Id] {
+			diff.SplitsRemoved = append(diff.SplitsRemoved, split.Id)
+		}
+	}
+
+	prev_players := map[string]bool{}
+	for _, player := range prev.SplitPlayers {
+		prev_players[splitPlayerKey(player.SplitId, player.PlayerID)] = true
+	}
+	next_players := map[string]bool{}
+	for _, player := range next.SplitPlayers {
+		key := splitPlayerKey(player.SplitId, player.PlayerID)
+		next_players[key] = true
+		if !prev_players[key] {
+			diff.SplitPlayersAdded = append(diff.SplitPlayersAdded, key)
+		}
+	}
+	for _, player := range prev.SplitPlayers {
+		key := splitPlayerKey(player.SplitId, player.PlayerID)
+		if !next_players[key] {
+			diff.SplitPlayersRemoved = append(diff.SplitPlayersRemoved, key)
+		}
+	}
+
+	prev_data := reportDataByKey(prev.SplitReportData)
+	next_data := reportDataByKey(next.SplitReportData)
+	for key, data := range next_data {
+		if !bytes.Equal(prev_data[key], data) {
+			diff.ReportDataChanged = append(diff.ReportDataChanged, key)
+		}
+	}
+	for key := range prev_data {
+		if _, ok := next_data[key]; !ok {
+			diff.ReportDataChanged = append(diff.ReportDataChanged, key)
+		}
+	}
+
+	return diff
+}
+
+// Ревизии тренировки клуба
+func (h *handler) adminEventRevisions(c jrpc.Context) error {
+	var params struct {
+		ClubId  int32  `json:"club_id"`
+		EventId string `json:"event_id"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminEventRevisions Bind error")
+	}
+
+	data := []EventRevision{}
+	if err := h.DB.Select(&data, `select * from api_sight."eventRevisionsList"($1, $2);`, params.ClubId, params.EventId); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "adminEventRevisions",
+			"event_id": params.EventId,
+			"error":    err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+/*
+Откат тренировки к сохраненной ревизии. Откат записывается новой ревизией,
+поэтому его можно отменить так же, как любую выгрузку
+*/
+func (h *handler) adminEventRollback(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params struct {
+		ClubId   int32  `json:"club_id"`
+		EventId  string `json:"event_id"`
+		Revision int64  `json:"revision"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminEventRollback Bind error")
+	}
+
+	TX, err := h.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Beginx error")
+	}
+	defer TX.Rollback()
+
+	current, err := eventRevisionCurrent(TX, params.ClubId, params.EventId)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return ErrorNotFound
+	}
+	if current.Revision == params.Revision {
+		return c.Result(EventSaveResult{Revision: current.Revision, Hash: current.Hash, Duplicate: true})
+	}
+
+	payload, err := eventRevisionPayload(TX, params.ClubId, params.EventId, params.Revision)
+	if err != nil {
+		return err
+	}
+
+	hash, err := payload.contentHash()
+	if err != nil {
+		return errors.Wrap(err, "adminEventRollback hash error")
+	}
+
+	if err := h.writeCalculatedEvent(TX, params.ClubId, payload); err != nil {
+		return err
+	}
+	if err := eventRevisionAdd(TX, params.ClubId, payload, current.Revision+1, hash, nil, &claims.ID); err != nil {
+		return err
+	}
+
+	if err := TX.Commit(); err != nil {
+		return errors.Wrap(err, "Commit error")
+	}
+
+	log.WithFields(log.Fields{
+		"proc":     "adminEventRollback",
+		"club_id":  params.ClubId,
+		"event_id": params.EventId,
+		"revision": params.Revision,
+		"user_id":  claims.ID,
+	}).Info("Event rolled back")
+
+	return c.Result(EventSaveResult{Revision: current.Revision + 1, Hash: hash})
+}
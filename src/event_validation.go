@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/mrFokin/jrpc"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Режим проверки event.save (EVENT_SAVE_VALIDATE): strict - выгрузка с ошибками отклоняется,
+warn - ошибки только пишутся в лог, off - проверка отключена
+*/
+const (
+	EventValidateStrict string = "strict"
+	EventValidateWarn   string = "warn"
+	EventValidateOff    string = "off"
+)
+
+const (
+	// Допуск выхода сплита за границы тренировки и времени в зонах за длительность сплита
+	eventValidateSlack = time.Minute
+	eventMaxDuration   = 24 * time.Hour
+	// Больше стольких ошибок в ответ не передается
+	eventValidateMaxIssues = 100
+
+	reportMaxLength       float32 = 100000
+	reportMaxSpeed        float32 = 50
+	reportMaxAcceleration float32 = 50
+	reportMaxPulse        int16   = 250
+)
+
+// Ошибка в выгрузке: путь к полю (например splits[2].stop_time), код и описание
+type ValidationIssue struct {
+	Path    string `json:"path"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Коды ошибок проверки
+const (
+	IssueRequired  string = "required"
+	IssueSchema    string = "schema"
+	IssueLength    string = "length"
+	IssueRange     string = "range"
+	IssueOrder     string = "order"
+	IssueReference string = "reference"
+	IssueDuplicate string = "duplicate"
+	IssueUnknown   string = "unknown"
+)
+
+func eventSaveInvalid(issues []ValidationIssue) error {
+	return jrpc.NewError(400, "Некорректные данные тренировки", issues)
+}
+
+// issues - ошибки, warnings - замечания, которые выгрузку не отклоняют ни в одном режиме
+type eventValidator struct {
+	issues   []ValidationIssue
+	warnings []ValidationIssue
+}
+
+func (v *eventValidator) add(path string, code string, format string, args ...interface{}) {
+	if len(v.issues) < eventValidateMaxIssues {
+		v.issues = append(v.issues, ValidationIssue{Path: path, Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (v *eventValidator) warn(path string, code string, format string, args ...interface{}) {
+	if len(v.warnings) < eventValidateMaxIssues {
+		v.warnings = append(v.warnings, ValidationIssue{Path: path, Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+func indexPath(list string, i int) string {
+	return list + "[" + strconv.Itoa(i) + "]"
+}
+
+// Длины массивов показателей сплита. Массив фиксированной длины при разборе молча обрезается или дополняется нулями
+var reportDataArrays = []struct {
+	name   string
+	length int
+}{
+	{"len_in_speed_zones", 5},
+	{"time_in_speed_zones", 5},
+	{"time_in_hr_zones", 5},
+	{"acceleration_cnt_by_zones", 4},
+	{"acceleration_length_by_zones", 4},
+	{"stop_count_by_zones", 4},
+}
+
+// Поля показателей сплита, известные серверу (json-теги SplitReportData)
+var reportDataKnown = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(SplitReportData{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+/*
+Проверка выгрузки до записи в БД: обязательные поля, согласованность времени, ссылки на сплиты
+внутри выгрузки, схема и диапазоны показателей. Пересечение сплитов с другими тренировками проверяет БД.
+Возвращает ошибки и замечания (неизвестные поля показателей из новых прошивок)
+*/
+func validateReverseRequest(params ReverseRequest) (issues []ValidationIssue, warnings []ValidationIssue) {
+	v := &eventValidator{}
+	event := params.Event
+
+	if event.Id == "" {
+		v.add("event.id", IssueRequired, "event id is empty")
+	}
+	if event.TeamId <= 0 {
+		v.add("event.team_id", IssueRequired, "team id is empty")
+	}
+	if event.StartTime.IsZero() || event.StopTime.IsZero() {
+		v.add("event", IssueRequired, "event start_time and stop_time are required")
+	} else if !event.StartTime.Before(event.StopTime) {
+		v.add("event.stop_time", IssueOrder, "stop_time must be after start_time")
+	} else if event.StopTime.Sub(event.StartTime) > eventMaxDuration {
+		v.add("event.stop_time", IssueRange, "event is longer than %s", eventMaxDuration)
+	}
+
+	sensors := map[int]int{}
+	players := map[int]int{}
+	for i, sensor := range params.EventSensors {
+		path := indexPath("event_sensors", i)
+		if sensor.EventId != event.Id {
+			v.add(path+".event_id", IssueReference, "sensor belongs to event %q", sensor.EventId)
+		}
+		if sensor.SensorId <= 0 {
+			v.add(path+".sensor_id", IssueRequired, "sensor id is empty")
+		} else if other, ok := sensors[sensor.SensorId]; ok && other != sensor.PlayerID {
+			v.add(path+".sensor_id", IssueDuplicate, "sensor %d is assigned to players %d and %d", sensor.SensorId, other, sensor.PlayerID)
+		}
+		if sensor.PlayerID <= 0 {
+			v.add(path+".player_id", IssueRequired, "player id is empty")
+		} else if other, ok := players[sensor.PlayerID]; ok && other != sensor.SensorId {
+			v.add(path+".player_id", IssueDuplicate, "player %d has sensors %d and %d", sensor.PlayerID, other, sensor.SensorId)
+		}
+		sensors[sensor.SensorId] = sensor.PlayerID
+		players[sensor.PlayerID] = sensor.SensorId
+	}
+
+	splits := map[string]SplitRow{}
+	for i, split := range params.Splits {
+		path := indexPath("splits", i)
+		if split.Id == "" {
+			v.add(path+".id", IssueRequired, "split id is empty")
+			continue
+		}
+		if _, ok := splits[split.Id]; ok {
+			v.add(path+".id", IssueDuplicate, "split %q is repeated", split.Id)
+		}
+		splits[split.Id] = split
+
+		if split.EventId != event.Id {
+			v.add(path+".event", IssueReference, "split belongs to event %q", split.EventId)
+		}
+		if !split.StartTime.Before(split.StopTime) {
+			v.add(path+".stop_time", IssueOrder, "stop_time must be after start_time")
+		}
+		if split.StartTime.Before(event.StartTime.Add(-eventValidateSlack)) || split.StopTime.After(event.StopTime.Add(eventValidateSlack)) {
+			v.add(path, IssueRange, "split is outside of the event time")
+		}
+		if len(split.Tags) > 0 && !bytes.Equal(split.Tags, []byte("null")) {
+			var tags SplitTags
+			if err := json.Unmarshal(split.Tags, &tags); err != nil {
+				v.add(path+".tags", IssueSchema, "tags must be an array of strings")
+			}
+		}
+	}
+
+	split_players := map[string]bool{}
+	for i, player := range params.SplitPlayers {
+		path := indexPath("split_players", i)
+		if _, ok := splits[player.SplitId]; !ok {
+			v.add(path+".split_id", IssueReference, "split %q is not in the payload", player.SplitId)
+		}
+		if player.PlayerID <= 0 {
+			v.add(path+".player_id", IssueRequired, "player id is empty")
+		}
+		key := splitPlayerKey(player.SplitId, player.PlayerID)
+		if split_players[key] {
+			v.add(path, IssueDuplicate, "player %d is repeated in split %q", player.PlayerID, player.SplitId)
+		}
+		split_players[key] = true
+	}
+
+	report_keys := map[string]bool{}
+	for i, raw := range params.SplitReportData {
+		path := indexPath("split_report_data", i)
+		data, ok := v.reportDataSchema(path, raw)
+		if !ok {
+			continue
+		}
+
+		split, ok := splits[data.SplitId]
+		if !ok {
+			v.add(path+".split_id", IssueReference, "split %q is not in the payload", data.SplitId)
+		}
+		key := splitPlayerKey(data.SplitId, data.PlayerId)
+		if !split_players[key] {
+			v.add(path+".player_id", IssueReference, "player %d is not in split %q", data.PlayerId, data.SplitId)
+		}
+		if report_keys[key] {
+			v.add(path, IssueDuplicate, "report data for player %d in split %q is repeated", data.PlayerId, data.SplitId)
+		}
+		report_keys[key] = true
+
+		var duration float32
+		if ok {
+			duration = float32((split.StopTime.Sub(split.StartTime) + eventValidateSlack).Seconds())
+		}
+		v.reportDataRanges(path, data, duration)
+	}
+
+	return v.issues, v.warnings
+}
+
+/*
+Схема показателей сплита: типы и длины массивов. Поля, которых сервер не знает, - замечание, а не ошибка:
+новая прошивка может добавить показатель раньше, чем его начнет сохранять API
+*/
+func (v *eventValidator) reportDataSchema(path string, raw json.RawMessage) (data SplitReportData, ok bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		v.add(path, IssueSchema, "report data must be an object")
+		return data, false
+	}
+
+	if err := json.Unmarshal(raw, &data); err != nil {
+		v.add(path, IssueSchema, "%s", err.Error())
+		return data, false
+	}
+
+	unknown := []string{}
+	for name := range fields {
+		if !reportDataKnown[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		v.warn(path+"."+name, IssueUnknown, "unknown field %s is ignored", name)
+	}
+
+	valid := true
+	for _, array := range reportDataArrays {
+		name, length := array.name, array.length
+		value, present := fields[name]
+		if !present {
+			continue
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(value, &items); err != nil || len(items) != length {
+			v.add(path+"."+name, IssueLength, "%s must have %d items", name, length)
+		}
+	}
+	if data.SplitId == "" {
+		v.add(path+".split_id", IssueRequired, "split id is empty")
+		valid = false
+	}
+	if data.PlayerId <= 0 {
+		v.add(path+".player_id", IssueRequired, "player id is empty")
+		valid = false
+	}
+	return data, valid
+}
+
+/*
+Диапазоны показателей. duration - длительность сплита в секундах с допуском,
+0 если сплит не найден (тогда время в зонах не сверяется)
+*/
+func (v *eventValidator) reportDataRanges(path string, data SplitReportData, duration float32) {
+	type metric struct {
+		name  string
+		value float64
+	}
+	type zones struct {
+		name   string
+		values []float64
+	}
+
+	float32s := func(values []float32) []float64 {
+		out := make([]float64, len(values))
+		for i, value := range values {
+			out[i] = float64(value)
+		}
+		return out
+	}
+	int64s := func(values []int64) []float64 {
+		out := make([]float64, len(values))
+		for i, value := range values {
+			out[i] = float64(value)
+		}
+		return out
+	}
+
+	non_negative := []metric{
+		{"sum_length", float64(data.SumLength)},
+		{"lps_seconds", float64(data.LpsSeconds)},
+		{"doppler_len", float64(data.DopplerLen)},
+		{"max_speed", float64(data.MaxSpeed)},
+		{"jump_count", float64(data.JumpCount)},
+		{"count_load_data", float64(data.CountLoad)},
+		{"max_load", float64(data.MaxLoad)},
+		{"sum_load", float64(data.SumLoad)},
+		{"count_pulse_values", float64(data.CountPulse)},
+		{"sum_pulse_values", float64(data.SumPulse)},
+		{"max_pulse", float64(data.MaxPulse)},
+		{"impact_count", float64(data.ImpactCount)},
+		{"accel_count", float64(data.AccelCount)},
+		{"stop_count", float64(data.StopCount)},
+		{"max_accel_pow", float64(data.MaxAccelPow)},
+		{"max_stop_pow", float64(data.MaxStopPow)},
+	}
+	for _, m := range non_negative {
+		if m.value < 0 {
+			v.add(path+"."+m.name, IssueRange, "%s is negative", m.name)
+		}
+	}
+
+	if data.SumLength > reportMaxLength {
+		v.add(path+".sum_length", IssueRange, "sum_length is above %v", reportMaxLength)
+	}
+	if data.DopplerLen > reportMaxLength {
+		v.add(path+".doppler_len", IssueRange, "doppler_len is above %v", reportMaxLength)
+	}
+	if data.MaxSpeed > reportMaxSpeed {
+		v.add(path+".max_speed", IssueRange, "max_speed is above %v", reportMaxSpeed)
+	}
+	if data.MaxAcceleration < -reportMaxAcceleration || data.MaxAcceleration > reportMaxAcceleration {
+		v.add(path+".max_acceleration", IssueRange, "max_acceleration is out of ±%v", reportMaxAcceleration)
+	}
+	if data.MaxPulse > reportMaxPulse {
+		v.add(path+".max_pulse", IssueRange, "max_pulse is above %d", reportMaxPulse)
+	}
+
+	times := []zones{
+		{"time_in_speed_zones", float32s(data.TimeInSpeedZones[:])},
+		{"time_in_hr_zones", float32s(data.TimeInHrZones[:])},
+	}
+	all := append([]zones{
+		{"len_in_speed_zones", float32s(data.LenInSpeedZones[:])},
+		{"acceleration_cnt_by_zones", int64s(data.AccCntByZones[:])},
+		{"acceleration_length_by_zones", float32s(data.AccLenByZones[:])},
+		{"stop_count_by_zones", int64s(data.StopCntByZones[:])},
+	}, times...)
+	for _, z := range all {
+		for _, value := range z.values {
+			if value < 0 {
+				v.add(path+"."+z.name, IssueRange, "%s has negative values", z.name)
+				break
+			}
+		}
+	}
+
+	if duration <= 0 {
+		return
+	}
+	if data.LpsSeconds > duration {
+		v.add(path+".lps_seconds", IssueRange, "lps_seconds is longer than the split")
+	}
+	for _, z := range times {
+		var total float64
+		for _, value := range z.values {
+			total += value
+		}
+		if total > float64(duration) {
+			v.add(path+"."+z.name, IssueRange, "%s total is longer than the split", z.name)
+		}
+	}
+}
+
+/*
+Проверка перед сохранением event.save согласно EVENT_SAVE_VALIDATE.
+В режиме warn ошибки пишутся в лог, а выгрузка сохраняется. Замечания только пишутся в лог
+*/
+func (h *handler) checkReverseRequest(board_id string, params ReverseRequest) error {
+	if h.cfg.EventSave.Validate == EventValidateOff {
+		return nil
+	}
+
+	issues, warnings := validateReverseRequest(params)
+	if len(warnings) > 0 {
+		log.WithFields(log.Fields{
+			"proc":     "checkReverseRequest",
+			"board_id": board_id,
+			"event_id": params.Event.Id,
+			"warnings": warnings,
+		}).Info("event.save payload has unknown fields")
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"proc":     "checkReverseRequest",
+		"board_id": board_id,
+		"event_id": params.Event.Id,
+		"issues":   issues,
+	}).Warn("Invalid event.save payload")
+
+	if h.cfg.EventSave.Validate == EventValidateWarn {
+		return nil
+	}
+	return eventSaveInvalid(issues)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Корректная выгрузка: 2 игрока, 3 сплита по минуте
+func validationTestRequest() ReverseRequest {
+	params := bulkTestRequest(bulkTestPlayers(2), 3)
+	params.Event.TeamId = 1
+	return params
+}
+
+// Показатели первой строки split_report_data с изменениями change
+func withReportData(params ReverseRequest, change func(fields map[string]interface{})) ReverseRequest {
+	var fields map[string]interface{}
+	json.Unmarshal(params.SplitReportData[0], &fields)
+	change(fields)
+	data, _ := json.Marshal(fields)
+
+	report := append([]json.RawMessage{}, params.SplitReportData...)
+	report[0] = data
+	params.SplitReportData = report
+	return params
+}
+
+func hasIssue(issues []ValidationIssue, path string, code string) bool {
+	for _, issue := range issues {
+		if issue.Path == path && issue.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateReverseRequest(t *testing.T) {
+	valid := validationTestRequest()
+
+	tests := []struct {
+		name    string
+		params  ReverseRequest
+		path    string
+		code    string
+		warning bool
+	}{
+		{name: "valid"},
+		{name: "event id empty", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.Event.Id = ""
+			return p
+		}(), path: "event.id", code: IssueRequired},
+		{name: "team id empty", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.Event.TeamId = 0
+			return p
+		}(), path: "event.team_id", code: IssueRequired},
+		{name: "event stops before start", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.Event.StopTime = p.Event.StartTime.Add(-time.Minute)
+			return p
+		}(), path: "event.stop_time", code: IssueOrder},
+		{name: "event longer than a day", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.Event.StopTime = p.Event.StartTime.Add(25 * time.Hour)
+			return p
+		}(), path: "event.stop_time", code: IssueRange},
+		{name: "sensor of two players", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.EventSensors = append(p.EventSensors, EventSensorsRow{EventId: p.Event.Id, SensorId: p.EventSensors[0].SensorId, PlayerID: 3})
+			return p
+		}(), path: "event_sensors[2].sensor_id", code: IssueDuplicate},
+		{name: "split repeated", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.Splits = append(p.Splits, p.Splits[0])
+			return p
+		}(), path: "splits[3].id", code: IssueDuplicate},
+		{name: "split outside of the event", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.Splits = append([]SplitRow{}, p.Splits...)
+			p.Splits[2].StopTime = p.Event.StopTime.Add(time.Hour)
+			return p
+		}(), path: "splits[2]", code: IssueRange},
+		{name: "split tags not strings", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.Splits = append([]SplitRow{}, p.Splits...)
+			p.Splits[0].Tags = json.RawMessage(`[1, 2]`)
+			return p
+		}(), path: "splits[0].tags", code: IssueSchema},
+		{name: "split player of unknown split", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.SplitPlayers = append(p.SplitPlayers, SplitPlayersRow{SplitId: "missing", PlayerID: 1})
+			return p
+		}(), path: "split_players[6].split_id", code: IssueReference},
+		{name: "report data not an object", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.SplitReportData = append([]json.RawMessage{json.RawMessage(`[1]`)}, p.SplitReportData[1:]...)
+			return p
+		}(), path: "split_report_data[0]", code: IssueSchema},
+		{name: "report data wrong type", params: withReportData(valid, func(f map[string]interface{}) {
+			f["max_speed"] = "fast"
+		}), path: "split_report_data[0]", code: IssueSchema},
+		{name: "report data array length", params: withReportData(valid, func(f map[string]interface{}) {
+			f["time_in_hr_zones"] = []float64{1, 2, 3}
+		}), path: "split_report_data[0].time_in_hr_zones", code: IssueLength},
+		{name: "report data player not in split", params: withReportData(valid, func(f map[string]interface{}) {
+			f["player_id"] = 5
+		}), path: "split_report_data[0].player_id", code: IssueReference},
+		{name: "report data repeated", params: func() ReverseRequest {
+			p := validationTestRequest()
+			p.SplitReportData = append(p.SplitReportData, p.SplitReportData[0])
+			return p
+		}(), path: "split_report_data[6]", code: IssueDuplicate},
+		{name: "unknown field is a warning", params: withReportData(valid, func(f map[string]interface{}) {
+			f["sprint_count"] = 3
+		}), path: "split_report_data[0].sprint_count", code: IssueUnknown, warning: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := tt.params
+			if tt.path == "" {
+				params = valid
+			}
+
+			issues, warnings := validateReverseRequest(params)
+			switch {
+			case tt.path == "":
+				if len(issues) != 0 || len(warnings) != 0 {
+					t.Fatalf("issues %v, warnings %v", issues, warnings)
+				}
+			case tt.warning:
+				if len(issues) != 0 {
+					t.Fatalf("issues %v, want none", issues)
+				}
+				if !hasIssue(warnings, tt.path, tt.code) {
+					t.Fatalf("warnings %v, want %s at %s", warnings, tt.code, tt.path)
+				}
+			default:
+				if !hasIssue(issues, tt.path, tt.code) {
+					t.Fatalf("issues %v, want %s at %s", issues, tt.code, tt.path)
+				}
+			}
+		})
+	}
+}
+
+func TestReportDataRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     SplitReportData
+		duration float32
+		path     string
+	}{
+		{name: "valid", data: SplitReportData{SumLength: 300, MaxSpeed: 8, LpsSeconds: 60, MaxPulse: 190}, duration: 120},
+		{name: "negative length", data: SplitReportData{SumLength: -1}, path: "p.sum_length"},
+		{name: "negative zone", data: SplitReportData{LenInSpeedZones: [5]float32{0, -5, 0, 0, 0}}, path: "p.len_in_speed_zones"},
+		{name: "speed above limit", data: SplitReportData{MaxSpeed: 51}, path: "p.max_speed"},
+		{name: "acceleration out of range", data: SplitReportData{MaxAcceleration: -51}, path: "p.max_acceleration"},
+		{name: "pulse above limit", data: SplitReportData{MaxPulse: 251}, path: "p.max_pulse"},
+		{name: "lps longer than split", data: SplitReportData{LpsSeconds: 121}, duration: 120, path: "p.lps_seconds"},
+		{name: "zone time longer than split", data: SplitReportData{TimeInHrZones: [5]float32{60, 61, 0, 0, 0}}, duration: 120, path: "p.time_in_hr_zones"},
+		{name: "split unknown, zone time not checked", data: SplitReportData{TimeInHrZones: [5]float32{600, 0, 0, 0, 0}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &eventValidator{}
+			v.reportDataRanges("p", tt.data, tt.duration)
+
+			if tt.path == "" {
+				if len(v.issues) != 0 {
+					t.Fatalf("issues %v, want none", v.issues)
+				}
+				return
+			}
+			if !hasIssue(v.issues, tt.path, IssueRange) {
+				t.Fatalf("issues %v, want range at %s", v.issues, tt.path)
+			}
+		})
+	}
+}
+
+func TestCheckReverseRequestModes(t *testing.T) {
+	valid := validationTestRequest()
+	invalid := withReportData(valid, func(f map[string]interface{}) {
+		f["max_speed"] = 100
+	})
+	unknown := withReportData(valid, func(f map[string]interface{}) {
+		f["sprint_count"] = 3
+	})
+
+	tests := []struct {
+		mode   string
+		kind   string
+		params ReverseRequest
+		reject bool
+	}{
+		{EventValidateStrict, "valid", valid, false},
+		{EventValidateStrict, "invalid", invalid, true},
+		{EventValidateStrict, "unknown field", unknown, false},
+		{EventValidateWarn, "valid", valid, false},
+		{EventValidateWarn, "invalid", invalid, false},
+		{EventValidateWarn, "unknown field", unknown, false},
+		{EventValidateOff, "valid", valid, false},
+		{EventValidateOff, "invalid", invalid, false},
+		{EventValidateOff, "unknown field", unknown, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.kind, func(t *testing.T) {
+			h := &handler{cfg: Config{EventSave: cfgEventSave{Validate: tt.mode}}}
+			err := h.checkReverseRequest("board-1", tt.params)
+			if (err != nil) != tt.reject {
+				t.Fatalf("err=%v, reject %v", err, tt.reject)
+			}
+		})
+	}
+}
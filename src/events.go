@@ -71,7 +71,14 @@ func (h *handler) eventsList(c jrpc.Context) error {
 
 	var data []EventInfo
 
-	if err := h.DB.Select(&data, `select * from api_sight."eventList"($1, $2, $3);`, club_id, params.StartTime, params.StopTime); err != nil {
+	query := `select * from api_sight."eventList"($1, $2, $3);`
+	args := []interface{}{club_id, params.StartTime, params.StopTime}
+	if player_id := h.requestPlayerID(c); player_id != nil {
+		query = `select * from api_sight."eventListPlayer"($1, $2, $3, $4);`
+		args = append(args, *player_id)
+	}
+
+	if err := h.DB.Select(&data, query, args...); err != nil {
 		log.WithFields(log.Fields{
 			"proc":  "eventsList",
 			"error": err,
@@ -93,9 +100,28 @@ func (h *handler) eventsGet(c jrpc.Context) error {
 		return errors.Wrap(err, "eventsGet Bind error")
 	}
 
-	var data EventInfo
+	var data struct {
+		EventInfo
+		Attachments int64 `json:"attachments" db:"-"`
+	}
+
+	query := `select * from api_sight."eventGet"($1, $2);`
+	args := []interface{}{club_id, id}
+	if player_id := h.requestPlayerID(c); player_id != nil {
+		query = `select * from api_sight."eventGetPlayer"($1, $2, $3);`
+		args = append(args, *player_id)
+	}
 
-	if err := h.DB.Get(&data, `select * from api_sight."eventGet"($1, $2);`, club_id, id); err != nil {
+	if err := h.DB.Get(&data, query, args...); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "eventsGet",
+			"event_id": id,
+			"error":    err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	if err := h.DB.Get(&data.Attachments, `select * from api_sight."attachmentsCount"($1, $2);`, club_id, id); err != nil {
 		log.WithFields(log.Fields{
 			"proc":     "eventsGet",
 			"event_id": id,
@@ -150,7 +176,14 @@ func (h *handler) splitsList(c jrpc.Context) error {
 
 	var data []SplitsInfo
 
-	if err := h.DB.Select(&data, `select * from api_sight."splitsList"($1, $2);`, club_id, pq.StringArray(params)); err != nil {
+	query := `select * from api_sight."splitsList"($1, $2);`
+	args := []interface{}{club_id, pq.StringArray(params)}
+	if player_id := h.requestPlayerID(c); player_id != nil {
+		query = `select * from api_sight."splitsListPlayer"($1, $2, $3);`
+		args = append(args, *player_id)
+	}
+
+	if err := h.DB.Select(&data, query, args...); err != nil {
 		log.WithFields(log.Fields{
 			"proc":  "splitsList",
 			"error": err,
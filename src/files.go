@@ -1,22 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"io"
+	"fmt"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 
 	"github.com/golang-jwt/jwt"
-	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 )
 
 type FileInfo struct {
-	OriginalfileName string `json:"name" db:"name"`
-	FileSize         int64  `json:"size" db:"size"`
-	MimeType         string `json:"type" db:"type"`
-	FileSystemName   string `json:"fs_name" db:"fs_name"`
+	OriginalfileName string                   `json:"name" db:"name"`
+	FileSize         int64                    `json:"size" db:"size"`
+	MimeType         string                   `json:"type" db:"type"`
+	FileSystemName   string                   `json:"fs_name" db:"fs_name"`
+	Hash             string                   `json:"sha256,omitempty" db:"sha256"`
+	Renditions       map[string]FileRendition `json:"renditions,omitempty" db:"renditions"`
 }
 
 func (a *FileInfo) Scan(value interface{}) error {
@@ -28,6 +30,70 @@ func (a *FileInfo) Scan(value interface{}) error {
 	return json.Unmarshal(b, &a)
 }
 
+// Имена всех файлов записи на диске, включая уменьшенные копии
+func (a *FileInfo) fsNames() []string {
+	names := []string{a.FileSystemName}
+	for _, r := range a.Renditions {
+		if r.FileSystemName != a.FileSystemName {
+			names = append(names, r.FileSystemName)
+		}
+	}
+	return names
+}
+
+func (h *handler) removeFiles(ctx context.Context, file_info FileInfo) {
+	h.releaseFiles(ctx, file_info.fsNames())
+}
+
+/*
+Отдает объект из хранилища файлов с поддержкой условных запросов (If-None-Match,
+If-Modified-Since) и диапазонов (Range). ETag - SHA-256 содержимого, если он известен,
+иначе слабый ETag из даты изменения и размера
+*/
+func (h *handler) serveStorageFile(c echo.Context, name string, mime_type string, hash string) error {
+	f, object, err := h.storage.Get(c.Request().Context(), name)
+	if err == ErrStorageNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer f.Close()
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, mime_type)
+	header.Set("Cache-Control", h.cfg.FilesCache)
+	if hash != "" {
+		header.Set("ETag", `"`+hash+`"`)
+	} else {
+		header.Set("ETag", fmt.Sprintf(`W/"%x-%x"`, object.ModTime.Unix(), object.Size))
+	}
+
+	http.ServeContent(c.Response(), c.Request(), "", object.ModTime, f)
+	return nil
+}
+
+/*
+Отдает логотип клуба из хранилища по logo_path/logo_mime из параметров клуба.
+Если логотип не задан, отдается заглушка fallback из каталога ресурсов
+*/
+func (h *handler) streamClubLogo(c echo.Context, params ClubParams, fallback string) error {
+	logo_path, ok := params["logo_path"].(string)
+	if !ok {
+		return c.File(strings.TrimSuffix(h.cfg.AssetsDir, "/") + "/" + fallback)
+	}
+
+	logo_mime := "image/png"
+	switch mime := params["logo_mime"].(type) {
+	case string:
+		logo_mime = mime
+	}
+
+	logo_hash, _ := params["logo_hash"].(string)
+
+	return h.serveStorageFile(c, logo_path, logo_mime, logo_hash)
+}
+
 type PlayerPhotoFileInfo struct {
 	Id       int32    `json:"file_id" db:"file_id"`
 	FileData FileInfo `json:"file_data" db:"file_data"`
@@ -39,20 +105,45 @@ func (h *handler) getPlayerPhoto(c echo.Context) error {
 	claims := c.Get("user").(*jwt.Token).Claims.(*UserClaims)
 	club_id := int(claims.Data["club_id"].(float64))
 
+	if player := claimsPlayerID(claims); player != nil && strconv.Itoa(int(*player)) != player_id {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
 	file_info := new(PlayerPhotoFileInfo)
 	err := h.DB.QueryRow(`SELECT * FROM api_sight."playersGetPhoto"($1, $2);`, player_id, club_id).Scan(&file_info.Id, &file_info.FileData)
 	if err != nil {
 		return c.Redirect(http.StatusSeeOther, "/player.png")
 	}
 
-	filepath := strings.TrimSuffix(h.cfg.FilesDir, "/") + "/" + file_info.FileData.FileSystemName
-	mime_type := file_info.FileData.MimeType
+	r := file_info.FileData.rendition(c.QueryParam("size"))
+	return h.serveStorageFile(c, r.FileSystemName, r.MimeType, r.Hash)
+}
 
-	f, err := os.Open(filepath)
+// Принимает изображение из поля "file" формы и готовит его копии
+func (h *handler) receiveImage(c echo.Context) (filename string, renditions map[string]ImageRendition, err error) {
+	file, err := c.FormFile("file")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		return "", nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if file.Size > h.cfg.PhotoMaxSize {
+		return "", nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, ErrImageTooLarge.Error())
+	}
+	src, err := file.Open()
+	if err != nil {
+		return "", nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
-	return c.Stream(http.StatusOK, mime_type, f)
+	defer src.Close()
+
+	renditions, err = processImage(src, h.cfg.PhotoMaxSize)
+	switch err {
+	case nil:
+		return file.Filename, renditions, nil
+	case ErrImageTooLarge:
+		return "", nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+	case ErrImageNotAllowed:
+		return "", nil, echo.NewHTTPError(http.StatusUnsupportedMediaType, err.Error())
+	}
+	return "", nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 }
 
 func (h *handler) uploadPlayerPhoto(c echo.Context) error {
@@ -62,58 +153,72 @@ func (h *handler) uploadPlayerPhoto(c echo.Context) error {
 	user_id := claims.ID
 	club_id := int(claims.Data["club_id"].(float64))
 
-	old_file_info := new(PlayerPhotoFileInfo)
-	err := h.DB.QueryRow(`SELECT * FROM api_sight."playersGetPhoto"($1, $2);`, player_id, club_id).Scan(&old_file_info.Id, &old_file_info.FileData)
-	if err == nil {
-		old_filepath := strings.TrimSuffix(h.cfg.FilesDir, "/") + "/" + old_file_info.FileData.FileSystemName
+	if claimsPlayerID(claims) != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
 
-		var found bool
-		err := h.DB.QueryRow(`SELECT * FROM api_sight."playersRmPhoto"($1, $2, $3);`, player_id, club_id, user_id).Scan(&found)
+	ctx := c.Request().Context()
+
+	filename, renditions, err := h.receiveImage(c)
+	if err != nil {
+		return err
+	}
+
+	new_file_info := FileInfo{
+		OriginalfileName: filename,
+		Renditions:       map[string]FileRendition{},
+	}
+
+	for name, rendition := range renditions {
+		rendition.FileSystemName, rendition.Hash, err = h.putBlob(ctx, rendition.Data, rendition.MimeType)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
 
-		_ = os.Remove(old_filepath)
+		new_file_info.Renditions[name] = rendition.FileRendition
 	}
 
-	file, err := c.FormFile("file")
+	original := new_file_info.Renditions[RenditionOriginal]
+	new_file_info.FileSystemName = original.FileSystemName
+	new_file_info.FileSize = original.FileSize
+	new_file_info.MimeType = original.MimeType
+	new_file_info.Hash = original.Hash
+
+	js_file_info, err := json.Marshal(new_file_info)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
-	src, err := file.Open()
+
+	// Замена фото в одной транзакции: при ошибке у игрока остается старое фото,
+	// а уже записанные новые файлы без ссылок уберет сборщик
+	TX, err := h.DB.Beginx()
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
-	defer src.Close()
+	defer TX.Rollback()
 
-	new_file_info := FileInfo{
-		OriginalfileName: file.Filename,
-		FileSize:         file.Size,
-		MimeType:         file.Header.Get("Content-Type"),
-		FileSystemName:   uuid.New().String(),
+	old_file_info := new(PlayerPhotoFileInfo)
+	err = TX.QueryRow(`SELECT * FROM api_sight."playersGetPhoto"($1, $2);`, player_id, club_id).Scan(&old_file_info.Id, &old_file_info.FileData)
+	has_old := err == nil
+	if has_old {
+		var found bool
+		if err := TX.QueryRow(`SELECT * FROM api_sight."playersRmPhoto"($1, $2, $3);`, player_id, club_id, user_id).Scan(&found); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
 	}
 
-	new_filepath := strings.TrimSuffix(h.cfg.FilesDir, "/") + "/" + new_file_info.FileSystemName
-
-	dst, err := os.Create(new_filepath)
+	var file_id *int
+	err = TX.QueryRow(`SELECT * FROM api_sight."playersAddPhoto"($1, $2, $3, $4);`, player_id, string(js_file_info), club_id, user_id).Scan(&file_id)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
-	defer dst.Close()
 
-	if _, err = io.Copy(dst, src); err != nil {
+	if err := TX.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	js_file_info, err := json.Marshal(new_file_info)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-	}
-
-	var file_id *int
-	err = h.DB.QueryRow(`SELECT * FROM api_sight."playersAddPhoto"($1, $2, $3, $4);`, player_id, string(js_file_info), club_id, user_id).Scan(&file_id)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	if has_old {
+		h.removeFiles(ctx, old_file_info.FileData)
 	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
@@ -132,22 +237,97 @@ func (h *handler) getClubLogo(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
 
-	filepath := strings.TrimSuffix(h.cfg.AssetsDir, "/") + "/noimage.png"
-	logo_mime := "image/png"
+	return h.streamClubLogo(c, club_info.Params, "noimage.png")
+}
 
-	switch logo_path := club_info.Params["logo_path"].(type) {
-	case string:
-		filepath = strings.TrimSuffix(h.cfg.FilesDir, "/") + "/" + logo_path
+// Параметры клуба с логотипом: путь в хранилище, тип и хэш содержимого
+func (h *handler) setClubLogo(c echo.Context, club_id int, user_id string, logo_path, logo_mime, logo_hash *string) error {
+	if _, err := h.DB.Exec(`SELECT * FROM api_sight."clubSetLogo"($1, $2, $3, $4, $5);`, club_id, logo_path, logo_mime, logo_hash, user_id); err != nil {
+		c.Echo().Logger.Errorj(map[string]interface{}{
+			"error":   err,
+			"proc":    "setClubLogo",
+			"club_id": club_id,
+			"message": "SQL error",
+		})
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return nil
+}
+
+/*
+Загрузка логотипа клуба. Новый файл сохраняется до обновления параметров клуба, старый освобождается после
+*/
+func (h *handler) uploadClubLogo(c echo.Context) error {
+	claims := c.Get("user").(*jwt.Token).Claims.(*UserClaims)
+	user_id := claims.ID
+	club_id := int(claims.Data["club_id"].(float64))
+
+	if claimsPlayerID(claims) != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
 	}
 
-	switch mime := club_info.Params["logo_mime"].(type) {
-	case string:
-		logo_mime = mime
+	ctx := c.Request().Context()
+
+	club_info := new(ClubInfo)
+	err := h.DB.QueryRow(`SELECT * FROM api_sight."clubGetById"($1);`, club_id).Scan(&club_info.Id, &club_info.Name, &club_info.CreateTime, &club_info.UpdateTime, &club_info.Params)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	_, renditions, err := h.receiveImage(c)
+	if err != nil {
+		return err
+	}
+
+	logo := renditions[RenditionMedium]
+	logo_path, logo_hash, err := h.putBlob(ctx, logo.Data, logo.MimeType)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := h.setClubLogo(c, club_id, user_id, &logo_path, &logo.MimeType, &logo_hash); err != nil {
+		return err
+	}
+
+	if old_path, ok := club_info.Params["logo_path"].(string); ok && old_path != logo_path {
+		h.releaseFiles(ctx, []string{old_path})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"result": true,
+		"data": map[string]interface{}{
+			"logo_hash": logo_hash,
+			"width":     logo.Width,
+			"height":    logo.Height,
+		},
+	})
+}
+
+// Удаление логотипа клуба. После него отдается заглушка noimage.png
+func (h *handler) deleteClubLogo(c echo.Context) error {
+	claims := c.Get("user").(*jwt.Token).Claims.(*UserClaims)
+	user_id := claims.ID
+	club_id := int(claims.Data["club_id"].(float64))
+
+	if claimsPlayerID(claims) != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
 	}
 
-	f, err := os.Open(filepath)
+	club_info := new(ClubInfo)
+	err := h.DB.QueryRow(`SELECT * FROM api_sight."clubGetById"($1);`, club_id).Scan(&club_info.Id, &club_info.Name, &club_info.CreateTime, &club_info.UpdateTime, &club_info.Params)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
-	return c.Stream(http.StatusOK, logo_mime, f)
+
+	if err := h.setClubLogo(c, club_id, user_id, nil, nil, nil); err != nil {
+		return err
+	}
+
+	if old_path, ok := club_info.Params["logo_path"].(string); ok {
+		h.releaseFiles(c.Request().Context(), []string{old_path})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"result": true,
+	})
 }
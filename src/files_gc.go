@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/lib/pq"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type cfgFilesGC struct {
+	Interval time.Duration `env:"FILES_GC_INTERVAL" envDefault:"24h"`
+	MinAge   time.Duration `env:"FILES_GC_MIN_AGE" envDefault:"24h"`
+	Remove   bool          `env:"FILES_GC_REMOVE" envDefault:"false"`
+}
+
+// Каталог хранилища с файлами, адресуемыми по SHA-256 содержимого
+const blobsPrefix string = "blobs"
+
+// Результат проверки соответствия файлов в хранилище и ссылок на них в БД
+type FilesGCReport struct {
+	StartTime    time.Time       `json:"start_time"`
+	Checked      int             `json:"checked"`
+	Orphans      []StorageObject `json:"orphans"`
+	OrphansSize  int64           `json:"orphans_size"`
+	Missing      []string        `json:"missing"`
+	Removed      int             `json:"removed"`
+	RemoveErrors int             `json:"remove_errors"`
+}
+
+func blobName(hash string) string {
+	return storageName(blobsPrefix, hash[:2], hash)
+}
+
+/*
+Сохраняет содержимое под именем по его SHA-256. Если такой файл уже есть, повторно он не пишется,
+пока не старше половины FILES_GC_MIN_AGE. Более старый файл перезаписывается: сборщик и releaseFiles
+не удаляют файлы моложе FILES_GC_MIN_AGE, и обновленное время защищает файл, пока ссылка на него
+еще не записана в БД
+*/
+func (h *handler) putBlob(ctx context.Context, data []byte, mime_type string) (name string, hash string, err error) {
+	return h.putBlobReader(ctx, bytes.NewReader(data), int64(len(data)), mime_type)
+}
+
+// То же для больших файлов: хэш считается первым проходом, при записи содержимое читается повторно
+func (h *handler) putBlobReader(ctx context.Context, r io.ReadSeeker, size int64, mime_type string) (name string, hash string, err error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", "", errors.Wrap(err, "putBlob read error")
+	}
+	hash = hex.EncodeToString(hasher.Sum(nil))
+	name = blobName(hash)
+
+	info, err := h.storage.Stat(ctx, name)
+	if err == nil && time.Since(info.ModTime) < h.cfg.FilesGC.MinAge/2 {
+		return name, hash, nil
+	}
+	if err != nil && err != ErrStorageNotFound {
+		return "", "", err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", "", errors.Wrap(err, "putBlob seek error")
+	}
+	if err := h.storage.Put(ctx, name, r, size, mime_type); err != nil {
+		return "", "", err
+	}
+	return name, hash, nil
+}
+
+/*
+Удаляет из хранилища файлы, на которые больше не ссылается ни одна запись в БД.
+Одинаковое содержимое хранится один раз, поэтому удалять файл без проверки нельзя.
+Файлы моложе FILES_GC_MIN_AGE остаются: их может сохранять параллельная загрузка, ссылка которой еще не записана
+*/
+func (h *handler) releaseFiles(ctx context.Context, names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	var referenced pq.StringArray
+	if err := h.DB.Get(&referenced, `select * from api_sight."filesReferenced"($1);`, pq.StringArray(names)); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "releaseFiles",
+			"names": names,
+			"error": err,
+		}).Error("SQL error")
+		return
+	}
+
+	for _, name := range names {
+		if inArray(name, []string(referenced)) >= 0 {
+			continue
+		}
+		if info, err := h.storage.Stat(ctx, name); err != nil || time.Since(info.ModTime) < h.cfg.FilesGC.MinAge {
+			continue
+		}
+		if err := h.storage.Delete(ctx, name); err != nil && err != ErrStorageNotFound {
+			log.WithFields(log.Fields{
+				"proc":  "releaseFiles",
+				"name":  name,
+				"error": err,
+			}).Error("Delete error")
+		}
+	}
+}
+
+// Файлы, управляемые API. Логи, сырые данные датчиков и файлы обновлений сборщик не трогает
+func filesGCManaged(name string) bool {
+	return !strings.Contains(name, "/") || strings.HasPrefix(name, blobsPrefix+"/")
+}
+
+// Все имена файлов, на которые ссылаются записи о файлах, вложения и параметры клубов
+func (h *handler) filesReferencedAll() (map[string]bool, error) {
+	var files []FilesRow
+	if err := h.DB.Select(&files, `select * from api_sight."filesListAll"();`); err != nil {
+		return nil, errors.Wrap(err, "filesListAll SQL error")
+	}
+
+	var logos []string
+	if err := h.DB.Select(&logos, `select * from api_sight."clubsLogoPaths"();`); err != nil {
+		return nil, errors.Wrap(err, "clubsLogoPaths SQL error")
+	}
+
+	var attachments []FileInfo
+	if err := h.DB.Select(&attachments, `select * from api_sight."attachmentsListAll"();`); err != nil {
+		return nil, errors.Wrap(err, "attachmentsListAll SQL error")
+	}
+
+	referenced := map[string]bool{}
+	for _, file := range files {
+		var file_info FileInfo
+		if err := json.Unmarshal(file.Data, &file_info); err != nil {
+			continue
+		}
+		for _, name := range file_info.fsNames() {
+			referenced[storageName(name)] = true
+		}
+	}
+	for _, file_info := range attachments {
+		for _, name := range file_info.fsNames() {
+			referenced[storageName(name)] = true
+		}
+	}
+	for _, name := range logos {
+		referenced[storageName(name)] = true
+	}
+	return referenced, nil
+}
+
+/*
+Сверяет хранилище с БД: файлы без ссылок (orphans) и ссылки без файлов (missing).
+Файлы моложе FILES_GC_MIN_AGE не считаются лишними, их запись в БД может быть еще не создана
+*/
+func (h *handler) filesGC(ctx context.Context, remove bool) (report FilesGCReport, err error) {
+	report.StartTime = time.Now()
+	report.Orphans = []StorageObject{}
+	report.Missing = []string{}
+
+	referenced, err := h.filesReferencedAll()
+	if err != nil {
+		return report, err
+	}
+
+	objects, err := h.storage.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+
+	present := map[string]bool{}
+	for _, object := range objects {
+		if !filesGCManaged(object.Name) {
+			continue
+		}
+		report.Checked++
+		present[object.Name] = true
+
+		if referenced[object.Name] || report.StartTime.Sub(object.ModTime) < h.cfg.FilesGC.MinAge {
+			continue
+		}
+		report.Orphans = append(report.Orphans, object)
+		report.OrphansSize += object.Size
+	}
+
+	for name := range referenced {
+		if !present[name] {
+			report.Missing = append(report.Missing, name)
+		}
+	}
+
+	if remove {
+		for _, object := range report.Orphans {
+			if err := h.storage.Delete(ctx, object.Name); err != nil && err != ErrStorageNotFound {
+				report.RemoveErrors++
+				continue
+			}
+			report.Removed++
+		}
+	}
+
+	return report, nil
+}
+
+// Периодический запуск сборщика. Удаляет файлы только при FILES_GC_REMOVE=true
+func (h *handler) runFilesGC(ctx context.Context) {
+	if h.cfg.FilesGC.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.cfg.FilesGC.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := h.filesGC(ctx, h.cfg.FilesGC.Remove)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"proc":  "runFilesGC",
+				"error": err,
+			}).Error("Files GC error")
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"proc":         "runFilesGC",
+			"checked":      report.Checked,
+			"orphans":      len(report.Orphans),
+			"orphans_size": report.OrphansSize,
+			"missing":      report.Missing,
+			"removed":      report.Removed,
+		}).Info("Files GC finished")
+	}
+}
+
+// Ручной запуск сборщика администратором. По умолчанию только отчет
+func (h *handler) adminFilesGC(c jrpc.Context) error {
+	var params struct {
+		Remove bool `json:"remove"`
+	}
+
+	// Параметры необязательны
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+
+	report, err := h.filesGC(c.EchoContext().Request().Context(), params.Remove)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "adminFilesGC",
+			"error": err,
+		}).Error("Files GC error")
+		return errors.Wrap(err, "adminFilesGC error")
+	}
+
+	return c.Result(report)
+}
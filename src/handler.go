@@ -9,10 +9,22 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Коды разрешений, проверяемые через checkPermissions
+const (
+	PermissionPlayersPurge int32 = 110
+	PermissionRecalc       int32 = 111
+	PermissionAdmin        int32 = 900
+)
+
 type handler struct {
-	DB  *sqlx.DB
-	jwt cfgJWT
-	cfg Config
+	DB      *sqlx.DB
+	jwt     cfgJWT
+	cfg     Config
+	storage FileStorage
+	// Очередь журнала репликации (см. auditEnqueue): объем тел в очереди и число отброшенных записей
+	audit        chan auditJob
+	auditQueued  *int64
+	auditDropped *int64
 }
 
 type UserClaims struct {
@@ -38,6 +50,14 @@ func newHandler(cfg Config) (h handler, err error) {
 	h.DB.SetMaxOpenConns(db.MaxOpenConns)
 	h.DB.SetMaxIdleConns(db.MaxIdleConns)
 	h.DB.SetConnMaxLifetime(db.ConnMaxLifetime)
+
+	h.storage, err = newFileStorage(cfg)
+	if err != nil {
+		return h, errors.Wrap(err, "File storage error")
+	}
+
+	h.audit = make(chan auditJob, cfg.Audit.Queue)
+	h.auditQueued, h.auditDropped = new(int64), new(int64)
 	return
 }
 
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+const (
+	RenditionThumb    string = "thumb"
+	RenditionMedium   string = "medium"
+	RenditionOriginal string = "original"
+
+	// Ограничение на размер изображения в пикселях, защищает от "бомб" распаковки
+	imageMaxPixels int = 40 * 1000 * 1000
+)
+
+// Размер длинной стороны для уменьшенных копий
+var imageRenditionSizes = map[string]int{
+	RenditionThumb:  160,
+	RenditionMedium: 640,
+}
+
+var (
+	ErrImageTooLarge   = errors.New("image is too large")
+	ErrImageNotAllowed = errors.New("unsupported image type")
+)
+
+// Допустимые типы изображений и формат, в котором сохраняются копии
+var imageAllowedTypes = map[string]imaging.Format{
+	"image/jpeg": imaging.JPEG,
+	"image/png":  imaging.PNG,
+	"image/gif":  imaging.PNG,
+}
+
+var imageFormatMime = map[imaging.Format]string{
+	imaging.JPEG: "image/jpeg",
+	imaging.PNG:  "image/png",
+}
+
+// Одна из сохраненных копий изображения
+type FileRendition struct {
+	FileSystemName string `json:"fs_name"`
+	FileSize       int64  `json:"size"`
+	MimeType       string `json:"type"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	Hash           string `json:"sha256,omitempty"`
+}
+
+// Готовое к сохранению изображение
+type ImageRendition struct {
+	FileRendition
+	Data []byte
+}
+
+/*
+Читает загруженное изображение не больше maxSize байт, определяет тип по содержимому,
+поворачивает по EXIF и перекодирует в набор копий. При перекодировании метаданные EXIF отбрасываются
+*/
+func processImage(src io.Reader, maxSize int64) (renditions map[string]ImageRendition, err error) {
+	body, err := ioutil.ReadAll(io.LimitReader(src, maxSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "processImage read error")
+	}
+	if int64(len(body)) > maxSize {
+		return nil, ErrImageTooLarge
+	}
+
+	format, ok := imageAllowedTypes[http.DetectContentType(body)]
+	if !ok {
+		return nil, ErrImageNotAllowed
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, ErrImageNotAllowed
+	}
+	if cfg.Width*cfg.Height > imageMaxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(body), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, ErrImageNotAllowed
+	}
+
+	renditions = map[string]ImageRendition{}
+
+	if renditions[RenditionOriginal], err = encodeRendition(img, format); err != nil {
+		return nil, err
+	}
+
+	for name, size := range imageRenditionSizes {
+		resized := img
+		if img.Bounds().Dx() > size || img.Bounds().Dy() > size {
+			resized = imaging.Fit(img, size, size, imaging.Lanczos)
+		}
+		if renditions[name], err = encodeRendition(resized, format); err != nil {
+			return nil, err
+		}
+	}
+
+	return renditions, nil
+}
+
+func encodeRendition(img image.Image, format imaging.Format) (r ImageRendition, err error) {
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, format, imaging.JPEGQuality(85)); err != nil {
+		return r, errors.Wrap(err, "encodeRendition error")
+	}
+
+	r.Data = buf.Bytes()
+	r.FileSize = int64(buf.Len())
+	r.MimeType = imageFormatMime[format]
+	r.Width = img.Bounds().Dx()
+	r.Height = img.Bounds().Dy()
+	return r, nil
+}
+
+// Копия нужного размера. Для записей без копий и неизвестных размеров отдается основной файл
+func (a *FileInfo) rendition(size string) FileRendition {
+	if r, ok := a.Renditions[size]; ok {
+		return r
+	}
+	return FileRendition{
+		FileSystemName: a.FileSystemName,
+		FileSize:       a.FileSize,
+		MimeType:       a.MimeType,
+		Hash:           a.Hash,
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
@@ -14,7 +15,8 @@ import (
 )
 
 const (
-	queryClubGetUUID string = `SELECT * FROM api_sight."clubGet"($1::uuid);`
+	queryClubGetUUID   string = `SELECT * FROM api_sight."clubGet"($1::uuid);`
+	queryUserGetPlayer string = `SELECT * FROM api_sight."userGetPlayer"($1, $2);`
 )
 
 func (h *handler) InternalsValidator(next echo.HandlerFunc) echo.HandlerFunc {
@@ -100,14 +102,32 @@ func (h *handler) getClaims(c jrpc.Context) error {
 		return err
 	}
 
+	// Пользователь, привязанный к игроку клуба, получает доступ только к своим данным
+	var player_id sql.NullInt32
+	if err := h.DB.Get(&player_id, queryUserGetPlayer, params.User, clubData.ID); err != nil && err != sql.ErrNoRows {
+		c.EchoContext().Echo().Logger.Errorj(map[string]interface{}{
+			"error":   err,
+			"proc":    "getClaims",
+			"message": "SQL error",
+			"user":    params.User,
+		})
+
+		return err
+	}
+
+	claims_data := map[string]interface{}{
+		"club_id": clubData.ID,
+	}
+	if player_id.Valid {
+		claims_data["player_id"] = player_id.Int32
+	}
+
 	claims := map[string]interface{}{
-		"id": params.User,
-		"data": map[string]interface{}{
-			"club_id": clubData.ID,
-		},
+		"id":   params.User,
+		"data": claims_data,
 	}
 
-	claims_data, err := json.Marshal(claims)
+	claims_json, err := json.Marshal(claims)
 	if err != nil {
 		c.EchoContext().Echo().Logger.Errorj(map[string]interface{}{
 			"error":      err,
@@ -119,7 +139,7 @@ func (h *handler) getClaims(c jrpc.Context) error {
 		})
 	}
 
-	data.Claims = (*json.RawMessage)(&claims_data)
+	data.Claims = (*json.RawMessage)(&claims_json)
 
 	return c.Result(data)
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/mrFokin/jrpc"
+)
+
+const (
+	listDefaultLimit int = 50
+	listMaxLimit     int = 500
+)
+
+/*
+Общие параметры методов *.list: поиск, сортировка и курсорная пагинация.
+Без paged метод отдает весь список массивом, как до пагинации, cursor и limit не учитываются
+*/
+type ListParams struct {
+	Search *string `json:"search"`
+	Sort   string  `json:"sort"`
+	Order  string  `json:"order"`
+	Paged  bool    `json:"paged"`
+	Cursor string  `json:"cursor"`
+	Limit  int     `json:"limit"`
+}
+
+// Ответ методов *.list с paged=true
+type ListResult struct {
+	Items      interface{} `json:"items"`
+	Total      int64       `json:"total"`
+	NextCursor *string     `json:"next_cursor"`
+}
+
+// Служебные колонки, которые возвращают списочные функции БД вместе с данными
+type ListRowMeta struct {
+	SortValue *string `json:"-" db:"sort_value"`
+	Total     int64   `json:"-" db:"total"`
+}
+
+// Позиция в выборке: значение поля сортировки и id последней отданной строки
+type listCursor struct {
+	Value *string `json:"v"`
+	Id    int32   `json:"id"`
+}
+
+func encodeListCursor(value *string, id int32) string {
+	b, _ := json.Marshal(listCursor{Value: value, Id: id})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeListCursor(s string) (cur *listCursor, err error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrorInvalidCursor
+	}
+
+	cur = new(listCursor)
+	if err := json.Unmarshal(b, cur); err != nil {
+		return nil, ErrorInvalidCursor
+	}
+	return cur, nil
+}
+
+/*
+Bind для необязательных параметров: без params v остается пустым,
+переданные, но некорректные параметры дают ErrorInvalidParams
+*/
+func bindOptional(c jrpc.Context, v interface{}) error {
+	var raw json.RawMessage
+	if err := c.Bind(&raw); err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return ErrorInvalidParams
+	}
+	return nil
+}
+
+/*
+Приводит параметры к допустимым значениям: поле сортировки из белого списка
+(без sort - первое значение списка), направление и лимит. Поле не из списка - ErrorInvalidParams
+*/
+func (p *ListParams) normalize(sortFields []string) error {
+	if p.Sort == "" {
+		p.Sort = sortFields[0]
+	}
+	if inArray(p.Sort, sortFields) < 0 {
+		return ErrorInvalidParams
+	}
+
+	if strings.ToLower(p.Order) == "desc" {
+		p.Order = "desc"
+	} else {
+		p.Order = "asc"
+	}
+
+	if p.Limit <= 0 {
+		p.Limit = listDefaultLimit
+	}
+	if p.Limit > listMaxLimit {
+		p.Limit = listMaxLimit
+	}
+
+	p.Search = normalizeSearch(p.Search)
+	return nil
+}
+
+// Поисковая строка в нижнем регистре с заменой "ё" на "е". Так же БД нормализует имена при сравнении
+func normalizeSearch(s *string) *string {
+	if s == nil {
+		return nil
+	}
+
+	r := strings.TrimSpace(*s)
+	if r == "" {
+		return nil
+	}
+
+	r = strings.ToLower(r)
+	r = strings.NewReplacer("ё", "е").Replace(r)
+	return &r
+}
+
+// Курсор на следующую страницу, если текущая страница заполнена полностью
+func nextListCursor(limit int, count int, value *string, id int32) *string {
+	if count < limit {
+		return nil
+	}
+
+	cur := encodeListCursor(value, id)
+	return &cur
+}
+
+// Позиция, с которой продолжить выборку, для передачи в функции БД
+func (p *ListParams) after() (value *string, id *int32, err error) {
+	if !p.Paged {
+		return nil, nil, nil
+	}
+
+	cur, err := decodeListCursor(p.Cursor)
+	if err != nil || cur == nil {
+		return nil, nil, err
+	}
+	return cur.Value, &cur.Id, nil
+}
+
+// Лимит для функций БД, null - без ограничения
+func (p *ListParams) pageLimit() *int {
+	if !p.Paged {
+		return nil
+	}
+	return &p.Limit
+}
+
+// Ответ метода: массив строк или ListResult для paged
+func (p *ListParams) result(items interface{}, count int, total int64, value *string, id int32) interface{} {
+	if !p.Paged {
+		return items
+	}
+
+	result := ListResult{Items: items, Total: total}
+	if count > 0 {
+		result.NextCursor = nextListCursor(p.Limit, count, value, id)
+	}
+	return result
+}
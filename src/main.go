@@ -26,7 +26,21 @@ type Config struct {
 	JWT            cfgJWT
 	Locals         cfgLocals
 	FilesDir       string `env:"FILES_PATH,required"`
+	Storage        cfgStorage
+	FilesGC        cfgFilesGC
+	Attachments    cfgAttachments
+	Uploads        cfgUploads
+	Resumable      cfgResumable
+	Recalc         cfgRecalc
+	Boards         cfgBoards
+	Tunnels        cfgTunnels
+	Signing        cfgSigning
+	Audit          cfgAudit
+	EventSave      cfgEventSave
 	AssetsDir      string `env:"ASSETS_PATH"  envDefault:"/assets"`
+	PhotoMaxSize   int64  `env:"PHOTO_MAX_SIZE" envDefault:"10485760"`
+	BoardRendition string `env:"BOARD_PHOTO_RENDITION" envDefault:"medium"`
+	FilesCache     string `env:"FILES_CACHE_CONTROL" envDefault:"private, no-cache"`
 }
 
 type cfgDB struct {
@@ -87,7 +101,12 @@ func main() {
 	locals.Method("claims.get", h.getClaims)
 
 	//#########   Методы репликации   #########
-	replication := jrpc.Endpoint(e, config.LocationPrefix+"/replication", middleware.BasicAuth(h.ReplicationMiddlewareAuth))
+	// Каждый запрос платы пишется в журнал репликации, после проверки подписи - отмечается в реестре плат
+	replicationAuth := []echo.MiddlewareFunc{h.ReplicationAudit, middleware.BasicAuth(h.ReplicationMiddlewareAuth), h.ReplicationVerifyDigest, h.BoardHeartbeat}
+
+	// Размер запроса ограничен для JSON-RPC методов до любого чтения тела, файлы загружаются отдельными маршрутами
+	replicationRPC := append([]echo.MiddlewareFunc{middleware.BodyLimit(config.EventSave.MaxRequest)}, replicationAuth...)
+	replication := jrpc.Endpoint(e, config.LocationPrefix+"/replication", replicationRPC...)
 	replication.Method("get.contractor", h.replicationContractorGet)
 	replication.Method("list.roles", h.replicationRolesList)
 	replication.Method("list.users", h.replicationUserList)
@@ -102,53 +121,129 @@ func main() {
 
 	replication.Method("ping", h.replicationPing)
 
-	e.GET(config.LocationPrefix+"/replication/files/:id", h.replicationGetFile, middleware.BasicAuth(h.ReplicationMiddlewareAuth))
-	e.GET(config.LocationPrefix+"/replication/club_logo", h.replicationGetClubLogo, middleware.BasicAuth(h.ReplicationMiddlewareAuth))
-	e.POST(config.LocationPrefix+"/replication/sensor_log", h.uploadLogFile, middleware.BasicAuth(h.ReplicationMiddlewareAuth))
-	e.POST(config.LocationPrefix+"/replication/sensor_raw", h.uploadRawFile, middleware.BasicAuth(h.ReplicationMiddlewareAuth))
-	e.GET(config.LocationPrefix+"/replication/update.yml", h.replicationGetCompose, middleware.BasicAuth(h.ReplicationMiddlewareAuth))
+	replication.Method("survey.templates", h.replicationSurveyTemplates)
+	replication.Method("survey.pending", h.replicationSurveyPending)
+	replication.Method("survey.push", h.replicationSurveyPush)
+
+	e.GET(config.LocationPrefix+"/replication/files/:id", h.replicationGetFile, replicationAuth...)
+	e.GET(config.LocationPrefix+"/replication/club_logo", h.replicationGetClubLogo, replicationAuth...)
+	e.POST(config.LocationPrefix+"/replication/sensor_log", h.uploadLogFile, replicationAuth...)
+	e.POST(config.LocationPrefix+"/replication/sensor_raw", h.uploadRawFile, replicationAuth...)
+
+	resumable := e.Group(config.LocationPrefix+"/replication/uploads", replicationAuth...)
+	resumable.POST("", h.resumableCreate)
+	resumable.HEAD("/:id", h.resumableOffset)
+	resumable.GET("/:id", h.resumableOffset)
+	resumable.PATCH("/:id", h.resumablePatch)
+	resumable.POST("/:id/finalize", h.resumableFinalize)
+	resumable.DELETE("/:id", h.resumableAbort)
+
+	e.GET(config.LocationPrefix+"/replication/update.yml", h.replicationGetCompose, replicationAuth...)
 
 	replication.Method("event.save", h.saveCalculatedEvent)
 
-	portableStub := jrpc.Endpoint(e, config.LocationPrefix+"/replication/portable", middleware.BasicAuth(h.ReplicationMiddlewareAuth))
-	portableStub.Method("version.update.needed", h.portableStub)
-	portableStub.Method("version.update", h.portableStub)
-	portableStub.Method("ssh.up", h.portableStub)
-	portableStub.Method("ssh.dn", h.portableStub)
+	portable := jrpc.Endpoint(e, config.LocationPrefix+"/replication/portable", replicationAuth...)
+	portable.Method("version.update.needed", h.versionUpdateNeeded)
+	portable.Method("version.update", h.versionUpdate)
+	portable.Method("version.update.report", h.versionUpdateReport)
+	portable.Method("ssh.up", h.sshUp)
+	portable.Method("ssh.dn", h.sshDown)
+
+	//#########   Администрирование   #########
+	admin := jrpc.Endpoint(e, config.LocationPrefix+"/admin", sessions.JWTWithRedirect("/auth/refresh"+config.RefreshPostfix, []byte(config.JWT.Secret), &UserClaims{}), h.AdminValidator)
+	admin.Method("files.gc", h.adminFilesGC)
+	admin.Method("uploads.list", h.adminUploadsList)
+	admin.Method("uploads.delete", h.adminUploadsDelete)
+	admin.Method("boards.list", h.adminBoardsList)
+	admin.Method("boards.channel", h.adminBoardsSetChannel)
+	admin.Method("boards.create", h.adminBoardsCreate)
+	admin.Method("boards.rotate", h.adminBoardsRotate)
+	admin.Method("boards.revoke", h.adminBoardsRevoke)
+
+	admin.Method("tunnels.open", h.adminTunnelsOpen)
+	admin.Method("tunnels.close", h.adminTunnelsClose)
+	admin.Method("tunnels.list", h.adminTunnelsList)
+
+	admin.Method("releases.list", h.adminReleasesList)
+	admin.Method("releases.create", h.adminReleasesCreate)
+	admin.Method("releases.rollout", h.adminReleasesRollout)
+	admin.Method("releases.withdraw", h.adminReleasesWithdraw)
+	admin.Method("releases.reports", h.adminReleasesReports)
+
+	admin.Method("compose.list", h.adminComposeList)
+	admin.Method("compose.create", h.adminComposeCreate)
+	admin.Method("compose.rollout", h.adminComposeRollout)
+	admin.Method("compose.withdraw", h.adminComposeWithdraw)
+	admin.Method("compose.fetches", h.adminComposeFetches)
+	admin.Method("compose.variables", h.adminComposeVariablesSet)
+	admin.Method("compose.preview", h.adminComposePreview)
+
+	admin.Method("events.revisions", h.adminEventRevisions)
+	admin.Method("events.rollback", h.adminEventRollback)
+
+	admin.Method("audit.list", h.adminAuditList)
+	admin.Method("audit.replay", h.adminAuditReplay)
+
+	e.GET(config.LocationPrefix+"/admin/uploads/:id", h.adminGetBoardUpload, sessions.JWTWithRedirect("/auth/refresh"+config.RefreshPostfix, []byte(config.JWT.Secret), &UserClaims{}), h.AdminValidator)
+	e.GET(config.LocationPrefix+"/admin/audit/:id/raw", h.adminGetAuditRaw, sessions.JWTWithRedirect("/auth/refresh"+config.RefreshPostfix, []byte(config.JWT.Secret), &UserClaims{}), h.AdminValidator)
 
 	//#########   Методы api   #########
 	web := jrpc.Endpoint(e, config.LocationPrefix+"/web", sessions.JWTWithRedirect("/auth/refresh"+config.RefreshPostfix, []byte(config.JWT.Secret), &UserClaims{}) /*, middleware.BodyDump(logJrpcRequest)*/)
 	web.Method("clubs.get", h.clubsGet)
-
-	web.Method("teams.list", h.teamsList)
-	web.Method("teams.create", h.teamsAdd)
-	web.Method("teams.get", h.teamsGet)
-	web.Method("teams.update", h.teamsUpdate)
-	web.Method("teams.delete", h.teamsDelete)
-
-	web.Method("positions.list", h.positionsList)
-	web.Method("positions.create", h.positionsAdd)
-	web.Method("positions.get", h.positionsGet)
-	web.Method("positions.update", h.positionsUpdate)
-	web.Method("positions.delete", h.positionsDelete)
-
-	web.Method("players.list", h.playersList)
-	web.Method("players.create", h.playersAdd)
+	web.Method("my.dashboard", h.myDashboard)
+
+	web.Method("teams.list", h.teamsList, h.staffOnly)
+	web.Method("teams.create", h.teamsAdd, h.staffOnly)
+	web.Method("teams.get", h.teamsGet, h.staffOnly)
+	web.Method("teams.update", h.teamsUpdate, h.staffOnly)
+	web.Method("teams.delete", h.teamsDelete, h.staffOnly)
+
+	web.Method("positions.list", h.positionsList, h.staffOnly)
+	web.Method("positions.create", h.positionsAdd, h.staffOnly)
+	web.Method("positions.get", h.positionsGet, h.staffOnly)
+	web.Method("positions.update", h.positionsUpdate, h.staffOnly)
+	web.Method("positions.delete", h.positionsDelete, h.staffOnly)
+
+	web.Method("players.list", h.playersList, h.staffOnly)
+	web.Method("players.create", h.playersAdd, h.staffOnly)
 	web.Method("players.get", h.playersGet)
-	web.Method("players.update", h.playersUpdate)
-	web.Method("players.delete", h.playersDelete)
-	web.Method("players.password.reset", h.playersResetPassword)
+	web.Method("players.update", h.playersUpdate, h.staffOnly)
+	web.Method("players.delete", h.playersDeactivate, h.staffOnly)
+	web.Method("players.deactivate", h.playersDeactivate, h.staffOnly)
+	web.Method("players.restore", h.playersRestore, h.staffOnly)
+	web.Method("players.purge", h.playersPurge, h.staffOnly, h.checkPermissions([]int32{PermissionPlayersPurge}))
+	web.Method("players.password.reset", h.playersResetPassword, h.staffOnly)
+
+	web.Method("players.maxpulse.suggestions", h.maxPulseSuggestionsList, h.staffOnly)
+	web.Method("players.maxpulse.accept", h.maxPulseSuggestionAccept, h.staffOnly)
+	web.Method("players.maxpulse.reject", h.maxPulseSuggestionReject, h.staffOnly)
 
 	web.Method("events.list", h.eventsList)
 	web.Method("events.get", h.eventsGet)
-	web.Method("splits.players", h.splitsPlayers)
+	web.Method("splits.players", h.splitsPlayers, h.staffOnly)
 	web.Method("splits.list", h.splitsList)
 
+	web.Method("events.attachments.list", h.eventAttachmentsList)
+	web.Method("events.attachments.delete", h.eventAttachmentsDelete, h.staffOnly)
+	web.Method("events.attachments.usage", h.eventAttachmentsUsage, h.staffOnly)
+
+	web.Method("recalc.algorithms", h.recalcAlgorithms, h.staffOnly)
+	web.Method("recalc.create", h.recalcCreate, h.staffOnly, h.checkPermissions([]int32{PermissionRecalc}))
+	web.Method("recalc.list", h.recalcList, h.staffOnly)
+	web.Method("recalc.get", h.recalcGet, h.staffOnly)
+	web.Method("recalc.apply", h.recalcApply, h.staffOnly, h.checkPermissions([]int32{PermissionRecalc}))
+	web.Method("recalc.discard", h.recalcDiscard, h.staffOnly, h.checkPermissions([]int32{PermissionRecalc}))
+
+	web.Method("boards.list", h.clubBoardsList, h.staffOnly)
+
+	web.Method("uploads.list", h.uploadsList, h.staffOnly)
+	web.Method("uploads.delete", h.uploadsDelete, h.staffOnly)
+
 	web.Method("survey.events.list", h.surveyEventsList)
 	web.Method("survey.events.get", h.surveyEventsGet)
 	web.Method("survey.events.response", h.surveyEventResponse)
 
-	web.Method("survey.daily.list", h.surveyDailyList)
+	web.Method("survey.daily.list", h.surveyDailyList, h.staffOnly)
 	web.Method("survey.daily.get", h.surveyDailyGet)
 	web.Method("survey.daily.response", h.surveyDailyResponse)
 	web.Method("survey.daily.days", h.surveyDailyDays)
@@ -156,12 +251,12 @@ func main() {
 
 	//#########   Отчеты   #########
 	api := jrpc.Endpoint(e, config.LocationPrefix+"/reports", sessions.JWTWithRedirect("/auth/refresh"+config.RefreshPostfix, []byte(config.JWT.Secret), &UserClaims{}) /*, middleware.BodyDump(logJrpcRequest)*/)
-	api.Method("reports.workout", h.reportWorkout)
-	api.Method("reports.match.table", h.reportMatchTable)
-	api.Method("reports.match.graph", h.reportMatchGraph)
+	api.Method("reports.workout", h.reportWorkout, h.staffOnly)
+	api.Method("reports.match.table", h.reportMatchTable, h.staffOnly)
+	api.Method("reports.match.graph", h.reportMatchGraph, h.staffOnly)
 	api.Method("reports.personal", h.reportPersonal)
-	api.Method("reports.survey.event", h.reportEventSurvey)
-	api.Method("reports.injure.graph", h.reportEventGraph)
+	api.Method("reports.survey.event", h.reportEventSurvey, h.staffOnly)
+	api.Method("reports.injure.graph", h.reportEventGraph, h.staffOnly)
 
 	//Отчёты PDF на бекенде
 	e.GET(config.LocationPrefix+"/report/workout", h.reportPDFWorkout, middleware.BasicAuth(h.ReplicationMiddlewareAuth))
@@ -177,9 +272,30 @@ func main() {
 	pg.GET("/player/:id", h.getPlayerPhoto)
 	pg.POST("/player/:id", h.uploadPlayerPhoto)
 	pg.GET("/club", h.getClubLogo)
+	pg.POST("/club", h.uploadClubLogo)
+	pg.DELETE("/club", h.deleteClubLogo)
+	pg.POST("/event/:id", h.uploadEventAttachment, h.attachmentBodyLimit())
+	pg.GET("/attachment/:id", h.getEventAttachment)
+	pg.GET("/upload/:id", h.getBoardUpload)
 
 	e.Logger.Debug("Started. version: ", compile_vars.GetVersion(), " build_time: ", compile_vars.GetBuildTime(), " config: ", fmt.Sprintf("%+v", config))
 
+	bgCtx, bgCancel := context.WithCancel(context.Background())
+	defer bgCancel()
+	go h.runFilesGC(bgCtx)
+	go h.runUploadsRetention(bgCtx)
+	go h.runRecalcJobs(bgCtx)
+	go h.runAuditRetention(bgCtx)
+	go h.runNoncesCleanup(bgCtx)
+
+	// Журнал репликации пишется и после остановки фоновых задач, пока не опустеет очередь
+	auditCtx, auditCancel := context.WithCancel(context.Background())
+	auditDone := make(chan struct{})
+	go func() {
+		h.runAuditWriter(auditCtx)
+		close(auditDone)
+	}()
+
 	go func() {
 		if err := e.Start(config.Host); err != nil {
 			e.Logger.Info("shutting down the server", err)
@@ -191,7 +307,10 @@ func main() {
 	<-quit
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	if err := e.Shutdown(ctx); err != nil {
+	err = e.Shutdown(ctx)
+	auditCancel()
+	<-auditDone
+	if err != nil {
 		e.Logger.Fatal(err)
 	}
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/golang-jwt/jwt"
+	"github.com/lib/pq"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Пики пульса вне этого диапазона считаются артефактами датчика
+	maxPulseMinPlausible int16 = 120
+	maxPulseMaxPlausible int16 = 230
+)
+
+type MaxPulseSuggestion struct {
+	Id         int32           `json:"id" db:"id"`
+	PlayerId   int32           `json:"player_id" db:"player_id"`
+	PlayerInfo json.RawMessage `json:"player_info" db:"player_info"`
+	EventId    string          `json:"event_id" db:"event_id"`
+	EventInfo  json.RawMessage `json:"event_info" db:"event_info"`
+	Current    *int16          `json:"current" db:"current"`
+	Observed   int16           `json:"observed" db:"observed"`
+	Status     string          `json:"status" db:"status"`
+}
+
+/*
+Пиковый пульс каждого игрока по данным сплитов сохраненной тренировки
+*/
+func observedMaxPulse(reportData []json.RawMessage) map[int]int16 {
+	peaks := map[int]int16{}
+	for _, raw := range reportData {
+		var rec SplitReportData
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			continue
+		}
+		if rec.MaxPulse < maxPulseMinPlausible || rec.MaxPulse > maxPulseMaxPlausible {
+			continue
+		}
+		if rec.MaxPulse > peaks[rec.PlayerId] {
+			peaks[rec.PlayerId] = rec.MaxPulse
+		}
+	}
+	return peaks
+}
+
+/*
+Сравнивает наблюдаемые пики пульса с max_pulse из профиля игроков и создает
+предложения обновить профиль. Вызывается после сохранения тренировки, ошибки только логируются
+*/
+func (h *handler) suggestMaxPulse(club_id int32, params ReverseRequest) {
+	peaks := observedMaxPulse(params.SplitReportData)
+	if len(peaks) == 0 {
+		return
+	}
+
+	player_ids := make([]int64, 0, len(peaks))
+	for id := range peaks {
+		player_ids = append(player_ids, int64(id))
+	}
+
+	var profiles []struct {
+		PlayerId int    `db:"id"`
+		MaxPulse *int16 `db:"max_pulse"`
+	}
+
+	if err := h.DB.Select(&profiles, `select * from api_sight."playersMaxPulse"($1, $2);`, club_id, pq.Int64Array(player_ids)); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "suggestMaxPulse",
+			"SQL":   "playersMaxPulse",
+			"error": err,
+		}).Error("SQL error")
+		return
+	}
+
+	for _, profile := range profiles {
+		observed := peaks[profile.PlayerId]
+		if profile.MaxPulse != nil && observed <= *profile.MaxPulse {
+			continue
+		}
+
+		if _, err := h.DB.Exec(`select * from api_sight."maxPulseSuggestionAdd"($1, $2, $3, $4);`,
+			club_id, profile.PlayerId, params.Event.Id, observed); err != nil {
+			log.WithFields(log.Fields{
+				"proc":      "suggestMaxPulse",
+				"SQL":       "maxPulseSuggestionAdd",
+				"player_id": profile.PlayerId,
+				"observed":  observed,
+				"error":     err,
+			}).Error("SQL error")
+		}
+	}
+}
+
+func (h *handler) maxPulseSuggestionsList(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := claims.Data["club_id"]
+
+	var params struct {
+		PlayerId *int32 `json:"player_id"`
+		Status   string `json:"status"`
+	}
+
+	// Параметры необязательны: по умолчанию отдаются все ожидающие решения предложения
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+	if params.Status == "" {
+		params.Status = "pending"
+	}
+
+	data := []MaxPulseSuggestion{}
+
+	if err := h.DB.Select(&data, `select * from api_sight."maxPulseSuggestionsList"($1, $2, $3);`, club_id, params.PlayerId, params.Status); err != nil {
+		log.WithFields(log.Fields{
+			"proc":   "maxPulseSuggestionsList",
+			"params": params,
+			"error":  err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+/*
+Принятие предложения: max_pulse игрока обновляется наблюдаемым значением.
+С recalculate пересчитывается кэш отчетов по тренировкам игрока, начиная с тренировки предложения
+*/
+func (h *handler) maxPulseSuggestionAccept(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := claims.Data["club_id"]
+	user_id := claims.ID
+
+	var params struct {
+		Id          int32 `json:"id"`
+		Recalculate bool  `json:"recalculate"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "maxPulseSuggestionAccept Bind error")
+	}
+
+	var accepted struct {
+		PlayerId int32          `db:"player_id"`
+		EventIds pq.StringArray `db:"event_ids"`
+	}
+
+	if err := h.DB.Get(&accepted, `select * from api_sight."maxPulseSuggestionAccept"($1, $2, $3);`, club_id, params.Id, user_id); err != nil {
+		log.WithFields(log.Fields{
+			"proc":   "maxPulseSuggestionAccept",
+			"params": params,
+			"error":  err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	recalculated := []string{}
+	if params.Recalculate {
+		for _, event_id := range accepted.EventIds {
+			if _, err := h.DB.Exec(queryReporCalcCache, club_id, event_id, accepted.PlayerId); err != nil {
+				log.WithFields(log.Fields{
+					"proc":     "maxPulseSuggestionAccept",
+					"SQL":      "prcReporCalcCache",
+					"event_id": event_id,
+					"error":    err,
+				}).Error("SQL error")
+				return errors.Wrap(err, "SQL error")
+			}
+			recalculated = append(recalculated, event_id)
+		}
+	}
+
+	return c.Result(map[string]interface{}{
+		"player_id":    accepted.PlayerId,
+		"recalculated": recalculated,
+	})
+}
+
+func (h *handler) maxPulseSuggestionReject(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := claims.Data["club_id"]
+	user_id := claims.ID
+
+	var id int32
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "maxPulseSuggestionReject Bind error")
+	}
+
+	var data bool
+
+	if err := h.DB.Get(&data, `select * from api_sight."maxPulseSuggestionReject"($1, $2, $3);`, club_id, id, user_id); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "maxPulseSuggestionReject",
+			"id":    id,
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"time"
 
@@ -24,25 +25,96 @@ type PlayersInfo struct {
 	Weight     *float32         `json:"current_weight" db:"current_weight"`
 	Height     *float32         `json:"current_height" db:"current_height"`
 	MaxPulse   *int32           `json:"max_pulse" db:"max_pulse"`
+	Active     *bool            `json:"active" db:"active"`
 	Data       *json.RawMessage `json:"data" db:"data"`
 }
 
+type PlayersListParams struct {
+	ListParams
+	TeamId     *int32  `json:"team_id"`
+	PositionId *int32  `json:"position"`
+	Active     *bool   `json:"active"`
+	AllPlayers bool    `json:"with_inactive"`
+	AgeFrom    *int    `json:"age_from"`
+	AgeTo      *int    `json:"age_to"`
+	Jersey     *string `json:"jersey"`
+}
+
+type PlayersListRow struct {
+	PlayersInfo
+	ListRowMeta
+}
+
+var playersSortFields = []string{"name", "jersey", "birth_date", "id"}
+
+// Границы даты рождения для возрастной группы [age_from; age_to] полных лет на сегодня
+func ageGroupBirthDates(from, to *int) (born_after, born_before *time.Time) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	if from != nil {
+		t := today.AddDate(-*from, 0, 0)
+		born_before = &t
+	}
+	if to != nil {
+		t := today.AddDate(-(*to + 1), 0, 1)
+		born_after = &t
+	}
+	return
+}
+
 func (h *handler) playersList(c jrpc.Context) error {
 	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
 	club_id := claims.Data["club_id"]
 
-	var data []PlayersInfo
+	var params PlayersListParams
+
+	// Параметры необязательны: вызов без params отдаёт всех активных игроков клуба
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+	if err := params.normalize(playersSortFields); err != nil {
+		return err
+	}
+
+	// Выбывшие игроки по умолчанию скрыты, чтобы не попадать в списки выбора
+	if params.Active == nil && !params.AllPlayers {
+		active := true
+		params.Active = &active
+	}
+
+	after_value, after_id, err := params.after()
+	if err != nil {
+		return err
+	}
+
+	born_after, born_before := ageGroupBirthDates(params.AgeFrom, params.AgeTo)
 
-	if err := h.DB.Select(&data, `select * from api_sight."playersList"($1);`, club_id); err != nil {
+	var rows []PlayersListRow
+
+	if err := h.DB.Select(&rows, `select * from api_sight."playersListFiltered"($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);`,
+		club_id, params.TeamId, params.PositionId, params.Active, born_after, born_before, params.Search, params.Jersey,
+		params.Sort, params.Order == "desc", after_value, after_id, params.pageLimit()); err != nil {
 		log.WithFields(log.Fields{
-			"proc":  "playersList",
-			"error": err,
+			"proc":   "playersList",
+			"params": params,
+			"error":  err,
 		}).Error("SQL error")
 		return errors.Wrap(err, "SQL error")
 	}
 
-	return c.Result(data)
+	var total int64
+	data := make([]PlayersInfo, 0, len(rows))
+	for _, row := range rows {
+		data = append(data, row.PlayersInfo)
+		total = row.Total
+	}
 
+	if len(rows) == 0 {
+		return c.Result(params.result(data, 0, total, nil, 0))
+	}
+	last := rows[len(rows)-1]
+	return c.Result(params.result(data, len(rows), total, last.SortValue, last.Id))
 }
 
 func (h *handler) playersGet(c jrpc.Context) error {
@@ -55,6 +127,10 @@ func (h *handler) playersGet(c jrpc.Context) error {
 		return errors.Wrap(err, "playersGet Bind error")
 	}
 
+	if player_id := h.requestPlayerID(c); player_id != nil && int(*player_id) != pl_id {
+		return ErrorForbidden
+	}
+
 	var data PlayersInfo
 
 	if err := h.DB.Get(&data, `select * from api_sight."playersGet"($1, $2);`, club_id, pl_id); err != nil {
@@ -148,30 +224,133 @@ func (h *handler) playersUpdate(c jrpc.Context) error {
 	return c.Result(data)
 }
 
-func (h *handler) playersDelete(c jrpc.Context) error {
+// Отчёт о данных игрока, которые будут удалены при окончательном удалении
+type PlayerPurgeReport struct {
+	PlayerId      int32 `json:"player_id" db:"player_id"`
+	Active        bool  `json:"active" db:"active"`
+	Events        int64 `json:"events" db:"events"`
+	Splits        int64 `json:"splits" db:"splits"`
+	ReportRecords int64 `json:"report_records" db:"report_records"`
+	SurveyAnswers int64 `json:"survey_answers" db:"survey_answers"`
+	Sensors       int64 `json:"sensors" db:"sensors"`
+	Files         int64 `json:"files" db:"files"`
+	Purged        bool  `json:"purged" db:"-"`
+}
+
+func (h *handler) playersSetActive(c jrpc.Context, proc string, active bool) error {
 	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
 	club_id := claims.Data["club_id"]
+	user_id := claims.ID
 
 	var id int
 
 	if err := c.Bind(&id); err != nil {
-		return errors.Wrap(err, "playersDelete Bind error")
+		return errors.Wrap(err, proc+" Bind error")
 	}
 
 	var data bool
 
-	if err := h.DB.Get(&data, `select * from api_sight."playersDelete"($1, $2);`, club_id, id); err != nil {
+	if err := h.DB.Get(&data, `select * from api_sight."playersSetActive"($1, $2, $3, $4);`, club_id, id, active, user_id); err != nil {
 		log.WithFields(log.Fields{
-			"proc":  "playersDelete",
+			"proc":  proc,
 			"id":    id,
 			"error": err,
 		}).Error("SQL error")
 		return errors.Wrap(err, "SQL error")
 	}
 
+	if !data {
+		return ErrorNotFound
+	}
+
 	return c.Result(data)
 }
 
+/*
+Перевод игрока в неактивные. Данные отчётов сохраняются, игрок пропадает из списков выбора
+*/
+func (h *handler) playersDeactivate(c jrpc.Context) error {
+	return h.playersSetActive(c, "playersDeactivate", false)
+}
+
+func (h *handler) playersRestore(c jrpc.Context) error {
+	return h.playersSetActive(c, "playersRestore", true)
+}
+
+/*
+Окончательное удаление игрока со всеми данными. По умолчанию (dry_run) только возвращает
+отчёт о том, что будет удалено. Удалить можно только предварительно деактивированного игрока.
+Отчет и удаление выполняются в одной транзакции с одним снимком данных, поэтому удаляется ровно то,
+что описано в отчете. Файлы игрока (фото) не удаляются сразу: после удаления ссылок их убирает сборщик файлов
+*/
+func (h *handler) playersPurge(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := int(claims.Data["club_id"].(float64))
+	user_id := claims.ID
+
+	params := struct {
+		Id     int  `json:"id"`
+		DryRun bool `json:"dry_run"`
+	}{DryRun: true}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "playersPurge Bind error")
+	}
+
+	TX, err := h.DB.BeginTxx(c.EchoContext().Request().Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return errors.Wrap(err, "Beginx error")
+	}
+	defer TX.Rollback()
+
+	var report PlayerPurgeReport
+
+	if err := TX.Get(&report, `select * from api_sight."playersPurgeReport"($1, $2);`, club_id, params.Id); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrorNotFound
+		}
+		log.WithFields(log.Fields{
+			"proc":   "playersPurge",
+			"SQL":    "playersPurgeReport",
+			"params": params,
+			"error":  err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	if params.DryRun {
+		return c.Result(report)
+	}
+
+	if report.Active {
+		return ErrorPlayerActive
+	}
+
+	if _, err := TX.Exec(`select * from api_sight."playersPurge"($1, $2, $3);`, club_id, params.Id, user_id); err != nil {
+		log.WithFields(log.Fields{
+			"proc":   "playersPurge",
+			"SQL":    "playersPurge",
+			"params": params,
+			"error":  err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	if err := TX.Commit(); err != nil {
+		return errors.Wrap(err, "Commit error")
+	}
+
+	log.WithFields(log.Fields{
+		"proc":    "playersPurge",
+		"club_id": club_id,
+		"user_id": user_id,
+		"report":  report,
+	}).Info("Player purged")
+
+	report.Purged = true
+	return c.Result(report)
+}
+
 func (h *handler) playersResetPassword(c jrpc.Context) error {
 	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
 	user_id := claims.ID
@@ -14,21 +14,56 @@ type PositionInfo struct {
 	Alias string `json:"alias" db:"alias"`
 }
 
+type PositionsListRow struct {
+	PositionInfo
+	ListRowMeta
+}
+
+var positionsSortFields = []string{"name", "alias", "id"}
+
 func (h *handler) positionsList(c jrpc.Context) error {
 	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
 	club_id := claims.Data["club_id"]
 
-	var data []PositionInfo
+	var params ListParams
+
+	// Параметры необязательны: вызов без params отдаёт весь список
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+	if err := params.normalize(positionsSortFields); err != nil {
+		return err
+	}
+
+	after_value, after_id, err := params.after()
+	if err != nil {
+		return err
+	}
+
+	var rows []PositionsListRow
 
-	if err := h.DB.Select(&data, `select * from api_sight."positionsList"($1);`, club_id); err != nil {
+	if err := h.DB.Select(&rows, `select * from api_sight."positionsListFiltered"($1, $2, $3, $4, $5, $6, $7);`,
+		club_id, params.Search, params.Sort, params.Order == "desc", after_value, after_id, params.pageLimit()); err != nil {
 		log.WithFields(log.Fields{
-			"proc":  "positionsList",
-			"error": err,
+			"proc":   "positionsList",
+			"params": params,
+			"error":  err,
 		}).Error("SQL error")
 		return errors.Wrap(err, "SQL error")
 	}
 
-	return c.Result(data)
+	var total int64
+	data := make([]PositionInfo, 0, len(rows))
+	for _, row := range rows {
+		data = append(data, row.PositionInfo)
+		total = row.Total
+	}
+
+	if len(rows) == 0 {
+		return c.Result(params.result(data, 0, total, nil, 0))
+	}
+	last := rows[len(rows)-1]
+	return c.Result(params.result(data, len(rows), total, last.SortValue, last.Id))
 }
 
 func (h *handler) positionsGet(c jrpc.Context) error {
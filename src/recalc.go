@@ -0,0 +1,674 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/golang-jwt/jwt"
+	"github.com/lib/pq"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type cfgRecalc struct {
+	Interval time.Duration `env:"RECALC_POLL_INTERVAL" envDefault:"30s"`
+	// Срок, на который экземпляр API берет задание. Задание продлевается, пока выполняется,
+	// задание упавшего экземпляра по истечении срока снова попадает в очередь
+	Lease time.Duration `env:"RECALC_LEASE" envDefault:"5m"`
+	// Относительное расхождение, которое не считается отличием при сравнении с расчетом платы
+	Tolerance float64 `env:"RECALC_DIFF_TOLERANCE" envDefault:"0.001"`
+}
+
+// Состояния задания пересчета
+const (
+	RecalcQueued    string = "queued"
+	RecalcRunning   string = "running"
+	RecalcDone      string = "done"
+	RecalcFailed    string = "failed"
+	RecalcApplied   string = "applied"
+	RecalcDiscarded string = "discarded"
+)
+
+// Данные тренировки для пересчета показателей сплитов
+type RecalcInput struct {
+	Event   EventInfo
+	Splits  []SplitsInfo
+	Sensors []EventSensorsRow
+	Uploads []BoardUploadInfo
+	Storage FileStorage
+	// Максимальный пульс игроков тренировки из карточек
+	MaxPulse map[int]int32
+}
+
+/*
+Алгоритм расчета показателей сплитов (SplitReportData) по сырым данным датчиков.
+Version попадает в задание и в сохраненные данные, поэтому изменение расчета - это новая версия,
+а не правка существующей. Реализации регистрируются через registerSplitAlgorithm в init()
+*/
+type SplitMetricsAlgorithm interface {
+	Version() string
+	Calculate(ctx context.Context, input RecalcInput) ([]SplitReportData, error)
+}
+
+var splitAlgorithms = map[string]SplitMetricsAlgorithm{}
+
+func registerSplitAlgorithm(algorithm SplitMetricsAlgorithm) {
+	splitAlgorithms[algorithm.Version()] = algorithm
+}
+
+type RecalcJob struct {
+	Id        int64  `json:"id" db:"id"`
+	ClubId    int32  `json:"club_id" db:"club_id"`
+	EventId   string `json:"event_id" db:"event_id"`
+	Algorithm string `json:"algorithm" db:"algorithm"`
+	Status    string `json:"status" db:"status"`
+	// Ревизия тренировки, по данным которой выполнен пересчет. null - тренировка сохранена без ревизий
+	BaseRevision *int64           `json:"base_revision" db:"base_revision"`
+	Error        *string          `json:"error" db:"error"`
+	Result       *json.RawMessage `json:"result,omitempty" db:"result"`
+	Diff         *json.RawMessage `json:"diff,omitempty" db:"diff"`
+	CreateTime   time.Time        `json:"create_time" db:"create_time"`
+	UpdateTime   *time.Time       `json:"update_time" db:"update_time"`
+	UserId       string           `json:"user_id" db:"user_id"`
+}
+
+/*
+Отличие пересчитанного значения от значения платы. Для строк, которые есть только
+в одном из расчетов, Field пустое, а отсутствующая сторона - null
+*/
+type RecalcDiffRow struct {
+	SplitId  string      `json:"split_id"`
+	PlayerId int         `json:"player_id"`
+	Field    string      `json:"field"`
+	Board    interface{} `json:"board"`
+	Server   interface{} `json:"server"`
+}
+
+type recalcKey struct {
+	SplitId  string
+	PlayerId int
+}
+
+func reportDataFields(data SplitReportData) map[string]interface{} {
+	fields := map[string]interface{}{}
+	js, _ := json.Marshal(data)
+	json.Unmarshal(js, &fields)
+	delete(fields, "split_id")
+	delete(fields, "player_id")
+	return fields
+}
+
+func recalcValuesEqual(a, b interface{}, tolerance float64) bool {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return false
+		}
+		scale := math.Max(math.Abs(av), math.Abs(bv))
+		return math.Abs(av-bv) <= tolerance*scale
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !recalcValuesEqual(av[i], bv[i], tolerance) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// Сравнивает показатели платы и пересчитанные по сплитам и игрокам
+func recalcDiff(board, server []SplitReportData, tolerance float64) []RecalcDiffRow {
+	diff := []RecalcDiffRow{}
+
+	board_rows := map[recalcKey]SplitReportData{}
+	for _, row := range board {
+		board_rows[recalcKey{row.SplitId, row.PlayerId}] = row
+	}
+
+	seen := map[recalcKey]bool{}
+	for _, row := range server {
+		key := recalcKey{row.SplitId, row.PlayerId}
+		seen[key] = true
+
+		board_row, ok := board_rows[key]
+		if !ok {
+			diff = append(diff, RecalcDiffRow{SplitId: row.SplitId, PlayerId: row.PlayerId, Server: row})
+			continue
+		}
+
+		board_fields := reportDataFields(board_row)
+		server_fields := reportDataFields(row)
+
+		names := make([]string, 0, len(server_fields))
+		for name := range server_fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if !recalcValuesEqual(board_fields[name], server_fields[name], tolerance) {
+				diff = append(diff, RecalcDiffRow{
+					SplitId:  row.SplitId,
+					PlayerId: row.PlayerId,
+					Field:    name,
+					Board:    board_fields[name],
+					Server:   server_fields[name],
+				})
+			}
+		}
+	}
+
+	for _, row := range board {
+		if !seen[recalcKey{row.SplitId, row.PlayerId}] {
+			diff = append(diff, RecalcDiffRow{SplitId: row.SplitId, PlayerId: row.PlayerId, Board: row})
+		}
+	}
+
+	return diff
+}
+
+// Показатели сплитов тренировки в том виде, в котором их прислала плата или сохранил прошлый пересчет
+func (h *handler) splitsReportData(club_id int32, event_id string) ([]SplitReportData, error) {
+	var rows []json.RawMessage
+	if err := h.DB.Select(&rows, `select * from api_sight."splitsReportDataGet"($1, $2);`, club_id, event_id); err != nil {
+		return nil, errors.Wrap(err, "splitsReportDataGet SQL error")
+	}
+
+	data := make([]SplitReportData, 0, len(rows))
+	for _, row := range rows {
+		var rec SplitReportData
+		if err := json.Unmarshal(row, &rec); err != nil {
+			return nil, errors.Wrap(err, "splitsReportDataGet unmarshal error")
+		}
+		data = append(data, rec)
+	}
+	return data, nil
+}
+
+func (h *handler) recalcInput(club_id int32, event_id string) (input RecalcInput, err error) {
+	input.Storage = h.storage
+
+	if err := h.DB.Get(&input.Event, `select * from api_sight."eventGet"($1, $2);`, club_id, event_id); err != nil {
+		return input, errors.Wrap(err, "eventGet SQL error")
+	}
+	if err := h.DB.Select(&input.Splits, `select * from api_sight."splitsList"($1, $2);`, club_id, pq.StringArray([]string{event_id})); err != nil {
+		return input, errors.Wrap(err, "splitsList SQL error")
+	}
+	if err := h.DB.Select(&input.Sensors, `select * from api_sight."eventSensorsList"($1, $2);`, club_id, event_id); err != nil {
+		return input, errors.Wrap(err, "eventSensorsList SQL error")
+	}
+
+	input.MaxPulse = map[int]int32{}
+	for _, sensor := range input.Sensors {
+		if _, ok := input.MaxPulse[sensor.PlayerID]; ok {
+			continue
+		}
+		var player PlayersInfo
+		if err := h.DB.Get(&player, `select * from api_sight."playersGet"($1, $2);`, club_id, sensor.PlayerID); err != nil {
+			return input, errors.Wrap(err, "playersGet SQL error")
+		}
+		input.MaxPulse[sensor.PlayerID] = 0
+		if player.MaxPulse != nil {
+			input.MaxPulse[sensor.PlayerID] = *player.MaxPulse
+		}
+	}
+
+	kind := UploadKindRaw
+	input.Uploads, err = h.boardUploadsList(BoardUploadsListParams{ClubId: &club_id, Kind: &kind, EventId: &event_id, Limit: listMaxLimit})
+	if err != nil {
+		return input, errors.Wrap(err, "boardUploadsList SQL error")
+	}
+	if len(input.Uploads) == 0 {
+		return input, errors.New("no raw uploads for event")
+	}
+	return input, nil
+}
+
+// Текущая ревизия тренировки, nil - тренировка сохранена без ревизий
+func (h *handler) recalcBaseRevision(club_id int32, event_id string) (*int64, error) {
+	TX, err := h.DB.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "Beginx error")
+	}
+	defer TX.Rollback()
+
+	current, err := eventRevisionCurrent(TX, club_id, event_id)
+	if err != nil || current == nil {
+		return nil, err
+	}
+	return &current.Revision, nil
+}
+
+/*
+Выполняет задание и сохраняет результат с отличиями от текущих данных. Данные тренировки не меняются.
+Ревизия читается до данных: если тренировку сохранят во время пересчета, применить его будет нельзя
+*/
+func (h *handler) processRecalcJob(ctx context.Context, job RecalcJob) (result []SplitReportData, diff []RecalcDiffRow, base *int64, err error) {
+	algorithm, ok := splitAlgorithms[job.Algorithm]
+	if !ok {
+		return nil, nil, nil, errors.New("unknown algorithm " + job.Algorithm)
+	}
+
+	base, err = h.recalcBaseRevision(job.ClubId, job.EventId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	input, err := h.recalcInput(job.ClubId, job.EventId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	result, err = algorithm.Calculate(ctx, input)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "Calculate error")
+	}
+
+	board, err := h.splitsReportData(job.ClubId, job.EventId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return result, recalcDiff(board, result, h.cfg.Recalc.Tolerance), base, nil
+}
+
+func (h *handler) finishRecalcJob(job RecalcJob, result []SplitReportData, diff []RecalcDiffRow, base *int64, job_err error) {
+	status := RecalcDone
+	var message, js_result, js_diff *string
+
+	if job_err != nil {
+		status = RecalcFailed
+		text := job_err.Error()
+		message = &text
+	} else {
+		result_bytes, _ := json.Marshal(result)
+		diff_bytes, _ := json.Marshal(diff)
+		result_text, diff_text := string(result_bytes), string(diff_bytes)
+		js_result, js_diff = &result_text, &diff_text
+	}
+
+	if _, err := h.DB.Exec(`select * from api_sight."recalcJobsFinish"($1, $2, $3, $4, $5, $6);`, job.Id, status, js_result, js_diff, base, message); err != nil {
+		log.WithFields(log.Fields{
+			"proc":   "finishRecalcJob",
+			"job_id": job.Id,
+			"error":  err,
+		}).Error("SQL error")
+	}
+}
+
+/*
+Продлевает срок задания, пока оно выполняется. Если срок продлить не удалось (задание уже взял
+другой экземпляр после истечения срока или оно удалено), выполнение прерывается через cancel
+*/
+func (h *handler) recalcHeartbeat(ctx context.Context, cancel context.CancelFunc, job_id int64) {
+	if h.cfg.Recalc.Lease <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.cfg.Recalc.Lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var extended bool
+		if err := h.DB.Get(&extended, `select * from api_sight."recalcJobsHeartbeat"($1, $2);`, job_id, h.cfg.Recalc.Lease.Seconds()); err != nil {
+			log.WithFields(log.Fields{
+				"proc":   "recalcHeartbeat",
+				"job_id": job_id,
+				"error":  err,
+			}).Error("SQL error")
+			continue
+		}
+		if !extended {
+			cancel()
+			return
+		}
+	}
+}
+
+/*
+Фоновая обработка очереди пересчета. recalcJobsNext переводит задание в running на срок RECALC_LEASE,
+поэтому несколько экземпляров API не возьмут одно задание дважды. Задание в running с истекшим сроком
+(экземпляр упал или перезапущен) recalcJobsNext выдает снова
+*/
+func (h *handler) runRecalcJobs(ctx context.Context) {
+	if h.cfg.Recalc.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.cfg.Recalc.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for ctx.Err() == nil {
+			var job RecalcJob
+			err := h.DB.Get(&job, `select * from api_sight."recalcJobsNext"($1);`, h.cfg.Recalc.Lease.Seconds())
+			if err == sql.ErrNoRows {
+				break
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"proc":  "runRecalcJobs",
+					"error": err,
+				}).Error("SQL error")
+				break
+			}
+
+			job_ctx, cancel := context.WithCancel(ctx)
+			go h.recalcHeartbeat(job_ctx, cancel, job.Id)
+			result, diff, base, err := h.processRecalcJob(job_ctx, job)
+			lost := job_ctx.Err() != nil && ctx.Err() == nil
+			cancel()
+
+			// Задание, срок которого продлить не удалось, уже выполняет другой экземпляр.
+			// При остановке API задание тоже не завершается и по истечении срока вернется в очередь
+			if lost || ctx.Err() != nil {
+				log.WithFields(log.Fields{
+					"proc":   "runRecalcJobs",
+					"job_id": job.Id,
+				}).Warn("Recalc job lease lost")
+				continue
+			}
+			h.finishRecalcJob(job, result, diff, base, err)
+
+			log.WithFields(log.Fields{
+				"proc":      "runRecalcJobs",
+				"job_id":    job.Id,
+				"event_id":  job.EventId,
+				"algorithm": job.Algorithm,
+				"diff":      len(diff),
+				"error":     err,
+			}).Info("Recalc job finished")
+		}
+	}
+}
+
+// Доступные версии алгоритма расчета
+func (h *handler) recalcAlgorithms(c jrpc.Context) error {
+	versions := []string{}
+	for version := range splitAlgorithms {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+
+	return c.Result(versions)
+}
+
+func (h *handler) recalcCreate(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := claims.Data["club_id"]
+
+	var params struct {
+		EventId   string `json:"event_id"`
+		Algorithm string `json:"algorithm"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "recalcCreate Bind error")
+	}
+
+	if _, ok := splitAlgorithms[params.Algorithm]; !ok {
+		return ErrorRecalcAlgorithm
+	}
+
+	var job RecalcJob
+	if err := h.DB.Get(&job, `select * from api_sight."recalcJobsAdd"($1, $2, $3, $4);`, club_id, params.EventId, params.Algorithm, claims.ID); err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "recalcCreate",
+			"event_id": params.EventId,
+			"error":    err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(job)
+}
+
+// Задания клуба без результатов и отличий, они отдаются в recalc.get
+func (h *handler) recalcList(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := claims.Data["club_id"]
+
+	var params struct {
+		EventId *string `json:"event_id"`
+		Status  *string `json:"status"`
+	}
+
+	// Параметры необязательны
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+
+	data := []RecalcJob{}
+	if err := h.DB.Select(&data, `select * from api_sight."recalcJobsList"($1, $2, $3);`, club_id, params.EventId, params.Status); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "recalcList",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	for i := range data {
+		data[i].Result = nil
+		data[i].Diff = nil
+	}
+
+	return c.Result(data)
+}
+
+func (h *handler) recalcGet(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := claims.Data["club_id"]
+
+	var id int64
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "recalcGet Bind error")
+	}
+
+	var job RecalcJob
+	if err := h.DB.Get(&job, `select * from api_sight."recalcJobsGet"($1, $2);`, club_id, id); err != nil {
+		return ErrorNotFound
+	}
+
+	return c.Result(job)
+}
+
+/*
+Показатели выгрузки с замененными строками пересчета: строки тех же сплита и игрока заменяются,
+новые добавляются в конец. Так же splitsReportDataReplace меняет показатели в БД
+*/
+func recalcMergeReportData(rows []json.RawMessage, result []SplitReportData) ([]json.RawMessage, error) {
+	replaced := map[recalcKey]json.RawMessage{}
+	for _, row := range result {
+		js_row, err := json.Marshal(row)
+		if err != nil {
+			return nil, err
+		}
+		replaced[recalcKey{row.SplitId, row.PlayerId}] = js_row
+	}
+
+	merged := make([]json.RawMessage, 0, len(rows)+len(result))
+	seen := map[recalcKey]bool{}
+	for _, row := range rows {
+		var rec SplitReportData
+		if err := json.Unmarshal(row, &rec); err != nil {
+			return nil, err
+		}
+		key := recalcKey{rec.SplitId, rec.PlayerId}
+		if js_row, ok := replaced[key]; ok {
+			row = js_row
+			seen[key] = true
+		}
+		merged = append(merged, row)
+	}
+	for _, row := range result {
+		if key := (recalcKey{row.SplitId, row.PlayerId}); !seen[key] {
+			merged = append(merged, replaced[key])
+		}
+	}
+	return merged, nil
+}
+
+// Не изменилась ли тренировка с тех пор, как пересчет прочитал ее данные
+func recalcBaseCurrent(current *EventRevision, base *int64) bool {
+	if current == nil || base == nil {
+		return current == nil && base == nil
+	}
+	return current.Revision == *base
+}
+
+/*
+Заменяет показатели сплитов тренировки пересчитанными и обновляет кэш отчетов.
+Применить можно только завершенный пересчет, после просмотра отличий, и только если тренировка
+не менялась после чтения ее данных пересчетом. Для тренировок с ревизиями применение
+записывается новой ревизией, как выгрузка платы или откат
+*/
+func (h *handler) recalcApply(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := int32(claims.Data["club_id"].(float64))
+
+	var id int64
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "recalcApply Bind error")
+	}
+
+	var job RecalcJob
+	if err := h.DB.Get(&job, `select * from api_sight."recalcJobsGet"($1, $2);`, club_id, id); err != nil {
+		return ErrorNotFound
+	}
+	if job.Status != RecalcDone || job.Result == nil {
+		return ErrorRecalcNotReady
+	}
+
+	var result []SplitReportData
+	if err := json.Unmarshal(*job.Result, &result); err != nil {
+		return errors.Wrap(err, "recalcApply Unmarshal error")
+	}
+
+	TX, err := h.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Beginx error")
+	}
+	defer TX.Rollback()
+
+	current, err := eventRevisionCurrent(TX, club_id, job.EventId)
+	if err != nil {
+		return err
+	}
+	if !recalcBaseCurrent(current, job.BaseRevision) {
+		return ErrorRecalcStale
+	}
+
+	var applied bool
+	if err := TX.Get(&applied, `select * from api_sight."recalcJobsApply"($1, $2, $3);`, club_id, id, claims.ID); err != nil {
+		return errors.Wrap(err, "SQL error")
+	}
+	if !applied {
+		return ErrorRecalcNotReady
+	}
+
+	players := map[int]bool{}
+	for _, row := range result {
+		js_row, err := json.Marshal(row)
+		if err != nil {
+			return errors.Wrap(err, "recalcApply Marshal error")
+		}
+		if _, err := TX.Exec(`select * from api_sight."splitsReportDataReplace"($1, $2, $3, $4);`, club_id, job.EventId, string(js_row), job.Algorithm); err != nil {
+			log.WithFields(log.Fields{
+				"proc":     "recalcApply",
+				"SQL":      "splitsReportDataReplace",
+				"job_id":   id,
+				"split_id": row.SplitId,
+				"error":    err,
+			}).Error("SQL error")
+			return errors.Wrap(err, "SQL error")
+		}
+		players[row.PlayerId] = true
+	}
+
+	if current != nil {
+		payload, err := eventRevisionPayload(TX, club_id, job.EventId, current.Revision)
+		if err != nil {
+			return err
+		}
+		if payload.SplitReportData, err = recalcMergeReportData(payload.SplitReportData, result); err != nil {
+			return errors.Wrap(err, "recalcApply merge error")
+		}
+		hash, err := payload.contentHash()
+		if err != nil {
+			return errors.Wrap(err, "recalcApply hash error")
+		}
+		if err := eventRevisionAdd(TX, club_id, payload, current.Revision+1, hash, nil, &claims.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := TX.Commit(); err != nil {
+		return errors.Wrap(err, "Commit error")
+	}
+
+	for player_id := range players {
+		if _, err := h.DB.Exec(queryReporCalcCache, club_id, job.EventId, player_id); err != nil {
+			log.WithFields(log.Fields{
+				"proc":     "recalcApply",
+				"SQL":      "prcReporCalcCache",
+				"event_id": job.EventId,
+				"error":    err,
+			}).Error("SQL error")
+			return errors.Wrap(err, "SQL error")
+		}
+	}
+
+	return c.Result(true)
+}
+
+func (h *handler) recalcDiscard(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	club_id := claims.Data["club_id"]
+
+	var id int64
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "recalcDiscard Bind error")
+	}
+
+	var discarded bool
+	if err := h.DB.Get(&discarded, `select * from api_sight."recalcJobsDiscard"($1, $2, $3);`, club_id, id, claims.ID); err != nil {
+		log.WithFields(log.Fields{
+			"proc":   "recalcDiscard",
+			"job_id": id,
+			"error":  err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+	if !discarded {
+		return ErrorRecalcNotReady
+	}
+
+	return c.Result(true)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Расчет показателей сплитов по сырым отсчетам датчиков, версия v1.
+Сырой файл платы - CSV, строка на отсчет: sensor_id,time_ms,speed,acceleration,load,pulse
+(время - unix в миллисекундах, скорость в м/с, ускорение в м/с², пульс 0 - нет данных).
+Строки с нечисловым sensor_id (заголовок, комментарии) пропускаются.
+Прыжки (jump_count) не считаются: вертикального ускорения в сырых данных нет
+*/
+type splitAlgorithmV1 struct{}
+
+func init() {
+	registerSplitAlgorithm(splitAlgorithmV1{})
+}
+
+// Отсчет датчика
+type rawSample struct {
+	Time  time.Time
+	Speed float64
+	Accel float64
+	Load  int64
+	Pulse int64
+}
+
+const (
+	// Интервал между отсчетами больше этого считается потерей связи и не учитывается во времени и дистанции
+	v1MaxGap = 5 * time.Second
+	// Пульс игрока, если максимальный пульс в карточке не задан
+	v1DefaultMaxPulse = 200
+	// Порог ускорения и торможения, м/с², и порог удара
+	v1AccelThreshold  = 2.0
+	v1ImpactThreshold = 10.0
+)
+
+var (
+	// Нижние границы зон скорости 2-5, м/с
+	v1SpeedZones = []float64{2, 4, 5.5, 7}
+	// Нижние границы пульсовых зон 2-5, доля максимального пульса
+	v1HrZones = []float64{0.6, 0.7, 0.8, 0.9}
+	// Нижние границы зон ускорений и торможений по пиковому значению, м/с²
+	v1AccelZones = []float64{2, 3, 4, 5}
+)
+
+func (splitAlgorithmV1) Version() string {
+	return "v1"
+}
+
+// Номер зоны: сколько нижних границ не больше значения
+func v1Zone(value float64, bounds []float64) int {
+	zone := 0
+	for _, bound := range bounds {
+		if value >= bound {
+			zone++
+		}
+	}
+	return zone
+}
+
+func parseRawSamples(r io.Reader, players map[int]int, samples map[int][]rawSample) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+		if len(fields) < 6 {
+			continue
+		}
+
+		sensor_id, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			continue
+		}
+		player_id, ok := players[sensor_id]
+		if !ok {
+			continue
+		}
+
+		var values [5]float64
+		for i := range values {
+			if values[i], err = strconv.ParseFloat(strings.TrimSpace(fields[i+1]), 64); err != nil {
+				return errors.Errorf("bad sample for sensor %d: %v", sensor_id, err)
+			}
+		}
+
+		samples[player_id] = append(samples[player_id], rawSample{
+			Time:  time.Unix(0, int64(values[0])*int64(time.Millisecond)),
+			Speed: values[1],
+			Accel: values[2],
+			Load:  int64(values[3]),
+			Pulse: int64(values[4]),
+		})
+	}
+	return scanner.Err()
+}
+
+// Показатели игрока по отсчетам одного сплита, упорядоченным по времени
+func v1SplitMetrics(samples []rawSample, max_pulse float64) (data SplitReportData) {
+	var accel_peak, accel_len float64
+	accel_sign := 0
+	impact := false
+
+	finishRun := func() {
+		if accel_sign == 0 {
+			return
+		}
+		zone := v1Zone(math.Abs(accel_peak), v1AccelZones) - 1
+		if accel_sign > 0 {
+			data.AccelCount++
+			data.AccCntByZones[zone]++
+			data.AccLenByZones[zone] += float32(accel_len)
+		} else {
+			data.StopCount++
+			data.StopCntByZones[zone]++
+		}
+		accel_sign, accel_peak, accel_len = 0, 0, 0
+	}
+
+	for i, s := range samples {
+		var dt float64
+		if i > 0 {
+			if gap := s.Time.Sub(samples[i-1].Time); gap > 0 && gap <= v1MaxGap {
+				dt = gap.Seconds()
+			}
+		}
+		length := s.Speed * dt
+
+		data.LpsSeconds += float32(dt)
+		data.SumLength += float32(length)
+		data.DopplerLen += float32(length)
+		data.MaxSpeed = float32(math.Max(float64(data.MaxSpeed), s.Speed))
+		data.MaxAcceleration = float32(math.Max(float64(data.MaxAcceleration), s.Accel))
+
+		zone := v1Zone(s.Speed, v1SpeedZones)
+		data.LenInSpeedZones[zone] += float32(length)
+		data.TimeInSpeedZones[zone] += float32(dt)
+
+		if s.Load > 0 {
+			data.CountLoad++
+			data.SumLoad += s.Load
+			if int32(s.Load) > data.MaxLoad {
+				data.MaxLoad = int32(s.Load)
+			}
+		}
+
+		if s.Pulse > 0 {
+			data.CountPulse++
+			data.SumPulse += s.Pulse
+			if int16(s.Pulse) > data.MaxPulse {
+				data.MaxPulse = int16(s.Pulse)
+			}
+			data.TimeInHrZones[v1Zone(float64(s.Pulse)/max_pulse, v1HrZones)] += float32(dt)
+		}
+
+		// Ускорения и торможения - серии отсчетов за порогом, зона - по пиковому значению серии
+		sign := 0
+		switch {
+		case s.Accel >= v1AccelThreshold:
+			sign = 1
+			data.MaxAccelPow = float32(math.Max(float64(data.MaxAccelPow), s.Accel*s.Speed))
+		case s.Accel <= -v1AccelThreshold:
+			sign = -1
+			data.MaxStopPow = float32(math.Max(float64(data.MaxStopPow), -s.Accel*s.Speed))
+		}
+		if sign != accel_sign {
+			finishRun()
+			accel_sign = sign
+		}
+		if sign != 0 {
+			accel_peak = math.Max(accel_peak, math.Abs(s.Accel))
+			accel_len += length
+		}
+
+		if math.Abs(s.Accel) >= v1ImpactThreshold {
+			if !impact {
+				data.ImpactCount++
+			}
+			impact = true
+		} else {
+			impact = false
+		}
+	}
+	finishRun()
+
+	return data
+}
+
+func (a splitAlgorithmV1) Calculate(ctx context.Context, input RecalcInput) ([]SplitReportData, error) {
+	players := map[int]int{}
+	for _, sensor := range input.Sensors {
+		players[sensor.SensorId] = sensor.PlayerID
+	}
+
+	samples := map[int][]rawSample{}
+	for _, upload := range input.Uploads {
+		r, _, err := input.Storage.Get(ctx, upload.FileSystemName)
+		if err != nil {
+			return nil, errors.Wrap(err, "raw upload "+upload.FileName)
+		}
+		err = parseRawSamples(r, players, samples)
+		r.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "raw upload "+upload.FileName)
+		}
+	}
+
+	player_ids := make([]int, 0, len(samples))
+	for player_id := range samples {
+		sort.Slice(samples[player_id], func(i, j int) bool {
+			return samples[player_id][i].Time.Before(samples[player_id][j].Time)
+		})
+		player_ids = append(player_ids, player_id)
+	}
+	sort.Ints(player_ids)
+
+	result := []SplitReportData{}
+	for _, split := range input.Splits {
+		if split.StartTime == nil || split.StopTime == nil {
+			continue
+		}
+
+		for _, player_id := range player_ids {
+			all := samples[player_id]
+			lo := sort.Search(len(all), func(i int) bool { return !all[i].Time.Before(*split.StartTime) })
+			hi := sort.Search(len(all), func(i int) bool { return all[i].Time.After(*split.StopTime) })
+			if lo >= hi {
+				continue
+			}
+
+			max_pulse := float64(v1DefaultMaxPulse)
+			if pulse, ok := input.MaxPulse[player_id]; ok && pulse > 0 {
+				max_pulse = float64(pulse)
+			}
+
+			data := v1SplitMetrics(all[lo:hi], max_pulse)
+			data.SplitId = split.Id
+			data.PlayerId = player_id
+			result = append(result, data)
+		}
+	}
+	return result, nil
+}
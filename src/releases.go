@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/golang-jwt/jwt"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Каналы обновлений. Канал платы задается администратором, по умолчанию stable
+const (
+	ChannelStable string = "stable"
+	ChannelBeta   string = "beta"
+)
+
+/*
+Выпуск ПО плат. ClubId/BoardId ограничивают выпуск клубом или платой, RolloutPercent -
+доля плат канала, которым выпуск предлагается. Отозванный выпуск (withdrawn) больше не предлагается,
+платы с ним получают предыдущий выпуск канала - так выполняется откат
+*/
+type ReleaseInfo struct {
+	Id             int64            `json:"id" db:"id"`
+	Version        string           `json:"version" db:"version"`
+	Channel        string           `json:"channel" db:"channel"`
+	Manifest       *json.RawMessage `json:"manifest" db:"manifest"`
+	ClubId         *int32           `json:"club_id" db:"club_id"`
+	BoardId        *string          `json:"board_id" db:"board_id"`
+	RolloutPercent int16            `json:"rollout_percent" db:"rollout_percent"`
+	Withdrawn      bool             `json:"withdrawn" db:"withdrawn"`
+	CreateTime     time.Time        `json:"create_time" db:"create_time"`
+	UserId         string           `json:"user_id" db:"user_id"`
+}
+
+// Результат установки выпуска, о котором сообщила плата
+type ReleaseReport struct {
+	ReleaseId  int64     `json:"release_id" db:"release_id"`
+	BoardId    string    `json:"board_id" db:"board_id"`
+	ClubId     int32     `json:"club_id" db:"club_id"`
+	Version    string    `json:"version" db:"version"`
+	Success    bool      `json:"success" db:"success"`
+	Message    *string   `json:"message" db:"message"`
+	ReportTime time.Time `json:"report_time" db:"report_time"`
+}
+
+/*
+Попадает ли плата в долю постепенного выпуска. Номер корзины зависит от платы и выпуска,
+поэтому при увеличении процента плата, уже получившая выпуск, из него не выпадает
+*/
+func releaseRolloutIncludes(release ReleaseInfo, board_id string) bool {
+	return rolloutIncludes(board_id, release.Version, release.BoardId != nil, release.RolloutPercent)
+}
+
+// Корзина платы 0..99 для выпуска key. Выпуск, адресованный самой плате, доступен ей всегда
+func rolloutIncludes(board_id string, key string, targeted bool, percent int16) bool {
+	if targeted || percent >= 100 {
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(board_id + "/" + key))
+	return int16(hash.Sum32()%100) < percent
+}
+
+/*
+Выпуск, который должен стоять на плате. releasesCandidates возвращает действующие выпуски
+канала платы для ее клуба и ее самой, от более точной цели и нового к старому
+*/
+func (h *handler) boardTargetRelease(club_id int32, board_id string) (*ReleaseInfo, error) {
+	var candidates []ReleaseInfo
+	if err := h.DB.Select(&candidates, `select * from api_replication."releasesCandidates"($1, $2);`, club_id, board_id); err != nil {
+		return nil, errors.Wrap(err, "releasesCandidates SQL error")
+	}
+
+	for i := range candidates {
+		if releaseRolloutIncludes(candidates[i], board_id) {
+			return &candidates[i], nil
+		}
+	}
+	return nil, nil
+}
+
+type boardVersionParams struct {
+	Version string `json:"version"`
+}
+
+// Версия платы из параметров, для старых плат - из заголовка X-Board-Version
+func (h *handler) requestBoardVersion(c jrpc.Context) string {
+	var params boardVersionParams
+
+	// Параметры необязательны
+	_ = c.Bind(&params)
+
+	if params.Version == "" {
+		if version := boardVersion(c.EchoContext()); version != nil {
+			return *version
+		}
+	}
+	return params.Version
+}
+
+// Нужно ли плате обновление: выпуск для нее есть и его версия отличается от установленной
+func (h *handler) versionUpdateNeeded(c jrpc.Context) error {
+	club_id := c.EchoContext().Get("club_id").(int32)
+	board_id := c.EchoContext().Get("board_id").(string)
+
+	release, err := h.boardTargetRelease(club_id, board_id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "versionUpdateNeeded",
+			"board_id": board_id,
+			"error":    err,
+		}).Error("SQL error")
+		return err
+	}
+
+	return c.Result(release != nil && release.Version != h.requestBoardVersion(c))
+}
+
+// Манифест выпуска для платы. Если обновление не нужно, возвращается false
+func (h *handler) versionUpdate(c jrpc.Context) error {
+	club_id := c.EchoContext().Get("club_id").(int32)
+	board_id := c.EchoContext().Get("board_id").(string)
+
+	release, err := h.boardTargetRelease(club_id, board_id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "versionUpdate",
+			"board_id": board_id,
+			"error":    err,
+		}).Error("SQL error")
+		return err
+	}
+
+	if release == nil || release.Version == h.requestBoardVersion(c) {
+		return c.Result(false)
+	}
+
+	return c.Result(map[string]interface{}{
+		"release_id": release.Id,
+		"version":    release.Version,
+		"channel":    release.Channel,
+		"manifest":   release.Manifest,
+	})
+}
+
+// Плата сообщает результат установки выпуска
+func (h *handler) versionUpdateReport(c jrpc.Context) error {
+	club_id := c.EchoContext().Get("club_id").(int32)
+	board_id := c.EchoContext().Get("board_id").(string)
+
+	var params struct {
+		ReleaseId int64   `json:"release_id"`
+		Version   string  `json:"version"`
+		Success   bool    `json:"success"`
+		Message   *string `json:"message"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "versionUpdateReport Bind error")
+	}
+
+	if _, err := h.DB.Exec(`select * from api_replication."releasesReport"($1, $2, $3, $4, $5, $6);`,
+		club_id, board_id, params.ReleaseId, params.Version, params.Success, params.Message); err != nil {
+		log.WithFields(log.Fields{
+			"proc":       "versionUpdateReport",
+			"board_id":   board_id,
+			"release_id": params.ReleaseId,
+			"error":      err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	if !params.Success {
+		log.WithFields(log.Fields{
+			"proc":       "versionUpdateReport",
+			"board_id":   board_id,
+			"release_id": params.ReleaseId,
+			"message":    params.Message,
+		}).Warn("Board update failed")
+	}
+
+	return c.Result(true)
+}
+
+func (h *handler) adminReleasesList(c jrpc.Context) error {
+	var params struct {
+		Channel *string `json:"channel"`
+	}
+
+	// Параметры необязательны
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+
+	data := []ReleaseInfo{}
+	if err := h.DB.Select(&data, `select * from api_sight."releasesList"($1);`, params.Channel); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "adminReleasesList",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+func (h *handler) adminReleasesCreate(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params ReleaseInfo
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminReleasesCreate Bind error")
+	}
+
+	if params.Version == "" || params.Manifest == nil {
+		return ErrorInvalidParams
+	}
+	if params.Channel == "" {
+		params.Channel = ChannelStable
+	}
+	if params.Channel != ChannelStable && params.Channel != ChannelBeta {
+		return ErrorInvalidParams
+	}
+	if params.RolloutPercent < 0 || params.RolloutPercent > 100 {
+		return ErrorInvalidParams
+	}
+
+	var data ReleaseInfo
+	if err := h.DB.Get(&data, `select * from api_sight."releasesAdd"($1, $2, $3, $4, $5, $6, $7);`,
+		params.Version, params.Channel, params.Manifest, params.ClubId, params.BoardId, params.RolloutPercent, claims.ID); err != nil {
+		log.WithFields(log.Fields{
+			"proc":    "adminReleasesCreate",
+			"version": params.Version,
+			"error":   err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Изменение доли плат постепенного выпуска
+func (h *handler) adminReleasesRollout(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params struct {
+		Id             int64 `json:"id"`
+		RolloutPercent int16 `json:"rollout_percent"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminReleasesRollout Bind error")
+	}
+	if params.RolloutPercent < 0 || params.RolloutPercent > 100 {
+		return ErrorInvalidParams
+	}
+
+	var data ReleaseInfo
+	if err := h.DB.Get(&data, `select * from api_sight."releasesSetRollout"($1, $2, $3);`, params.Id, params.RolloutPercent, claims.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrorNotFound
+		}
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Отзыв выпуска. Платы, уже получившие его, откатываются на предыдущий выпуск канала
+func (h *handler) adminReleasesWithdraw(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var id int64
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "adminReleasesWithdraw Bind error")
+	}
+
+	var data ReleaseInfo
+	if err := h.DB.Get(&data, `select * from api_sight."releasesWithdraw"($1, $2);`, id, claims.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrorNotFound
+		}
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+func (h *handler) adminReleasesReports(c jrpc.Context) error {
+	var id int64
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "adminReleasesReports Bind error")
+	}
+
+	data := []ReleaseReport{}
+	if err := h.DB.Select(&data, `select * from api_sight."releasesReports"($1);`, id); err != nil {
+		log.WithFields(log.Fields{
+			"proc":       "adminReleasesReports",
+			"release_id": id,
+			"error":      err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Канал обновлений платы
+func (h *handler) adminBoardsSetChannel(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params struct {
+		BoardId string `json:"board_id"`
+		Channel string `json:"channel"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminBoardsSetChannel Bind error")
+	}
+	if params.Channel != ChannelStable && params.Channel != ChannelBeta {
+		return ErrorInvalidParams
+	}
+
+	var found bool
+	if err := h.DB.Get(&found, `select * from api_sight."boardsSetChannel"($1, $2, $3);`, params.BoardId, params.Channel, claims.ID); err != nil {
+		return errors.Wrap(err, "SQL error")
+	}
+	if !found {
+		return ErrorNotFound
+	}
+
+	return c.Result(true)
+}
@@ -2,13 +2,9 @@ package main
 
 import (
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base64"
 	"encoding/json"
-	"io"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
 	"time"
 
@@ -57,6 +53,7 @@ type ClubsRow struct {
 	CreateTime time.Time        `json:"created_at" db:"created_at"`
 	Params     *json.RawMessage `json:"params" db:"params"`
 	UID        string           `json:"uid" sql:",type:uuid" db:"uid"`
+	LogoHash   *string          `json:"logo_hash" db:"-"`
 }
 
 type TeamsRow struct {
@@ -95,8 +92,9 @@ type PlayersRow struct {
 }
 
 type FilesRow struct {
-	ID   int             `json:"id" db:"id"`
-	Data json.RawMessage `json:"file_data" db:"file_data"`
+	ID        int             `json:"id" db:"id"`
+	Data      json.RawMessage `json:"file_data" db:"file_data"`
+	Rendition *FileRendition  `json:"rendition" db:"-"`
 }
 
 // ############### Типы данных для обратной репликации ###################
@@ -153,91 +151,112 @@ type ReverseRequest struct {
 	Splits          []SplitRow        `json:"splits"`
 	SplitPlayers    []SplitPlayersRow `json:"split_players"`
 	SplitReportData []json.RawMessage `json:"split_report_data"`
-}
-
+	// Ревизия, на которой основана выгрузка, и хэш ее содержимого. Старые платы их не передают
+	Revision *int64  `json:"revision,omitempty"`
+	Hash     *string `json:"hash,omitempty"`
+}
+
+/*
+Проверка платы: BasicAuth и, для плат с аппаратным ключом, подпись запроса.
+Подпись - base64(sha256(X-Request-Id + X-Device-Id + X-Content-Digest + X-Timestamp + hw)),
+у старых плат без X-Timestamp она совпадает с прежней.
+После ротации у платы несколько действующих пар secret/hw, подходит любая из них (см. boardCredentials).
+Если хотя бы у одной пары есть аппаратный ключ, подпись обязательна: пара без ключа, оставшаяся
+на время перекрытия, не позволяет обойти подпись. Без подписи принимаются только платы, у которых ключа нет ни в одной паре.
+Повтор X-Request-Id отклоняется, соответствие X-Content-Digest телу проверяет ReplicationVerifyDigest
+*/
 func (h *handler) ReplicationMiddlewareAuth(username, password string, c echo.Context) (bool, error) {
-	var data struct {
-		secret  sql.NullString `db:"secret"`
-		club_id sql.NullInt32  `db:"club_id"`
-		hw      sql.NullString `db:"hw"`
-	}
-
-	if err := h.DB.QueryRow(`select * from api_replication."getBoardSecret"($1);`, username).Scan(&data.secret, &data.club_id, &data.hw); err != nil {
+	credentials, err := h.boardCredentials(username)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"username": username,
-			"password": password,
 			"error":    err,
 			"proc":     "ReplicationMiddlewareAuth",
 		}).Error("ReplicationMiddlewareAuth SQL error")
 		return false, errors.Wrap(err, "ReplicationMiddlewareAuth SQL error")
 	}
-	if !data.secret.Valid {
-		log.WithFields(log.Fields{
-			"username": username,
-			"password": password,
-			"proc":     "ReplicationMiddlewareAuth",
-		}).Error("ReplicationMiddlewareAuth no such username")
-		return false, errors.New("ReplicationMiddlewareAuth no such username " + username + " " + password)
+	if len(credentials) == 0 {
+		replicationAuthFailed(c, username, "no such username")
+		return false, nil
+	}
+	hw_required := false
+	for _, credential := range credentials {
+		if credential.Revoked {
+			replicationAuthFailed(c, username, "board revoked")
+			return false, nil
+		}
+		if credential.Hw.Valid {
+			hw_required = true
+		}
 	}
 
-	if data.secret.String != password {
-		log.WithFields(log.Fields{
-			"username": username,
-			"password": password,
-			"proc":     "ReplicationMiddlewareAuth",
-		}).Error("ReplicationMiddlewareAuth passwords don't match")
-
+	matched := []BoardCredential{}
+	for _, credential := range credentials {
+		if secureEqual(credential.Secret, password) && credential.Hw.Valid == hw_required {
+			matched = append(matched, credential)
+		}
+	}
+	if len(matched) == 0 {
+		replicationAuthFailed(c, username, "passwords don't match")
 		return false, nil
 	}
 
-	if data.hw.Valid {
-		var req_id string = ""
-		var dev_id string = ""
-		var digest string = ""
-		var in_signature string = ""
-		for header_name, header_values := range c.Request().Header {
-			if strings.ToLower(header_name) == "x-request-id" {
-				for _, v := range header_values {
-					req_id = req_id + v
-				}
-			}
-			if strings.ToLower(header_name) == "x-device-id" {
-				for _, v := range header_values {
-					dev_id = dev_id + v
-				}
-			}
-			if strings.ToLower(header_name) == "x-content-digest" {
-				for _, v := range header_values {
-					digest = digest + v
-				}
-			}
-			if strings.ToLower(header_name) == "x-signature" {
-				for _, v := range header_values {
-					in_signature = in_signature + v
-				}
-			}
+	var credential *BoardCredential
+	if !hw_required {
+		credential = &matched[0]
+	} else {
+		req := c.Request()
+		req_id := headerJoined(req, headerRequestId)
+		dev_id := headerJoined(req, headerDeviceId)
+		digest := headerJoined(req, headerContentDigest)
+		timestamp := headerJoined(req, headerTimestamp)
+		in_signature := headerJoined(req, headerSignature)
+
+		if !secureEqual(username, dev_id) {
+			replicationAuthFailed(c, username, "request host id did not match")
+			return false, nil
 		}
-		if username != dev_id {
-			log.WithFields(log.Fields{
-				"proc": "ReplicationMiddlewareAuth",
-				"url":  c.Request().RequestURI,
-			}).Error("Request host id did not match")
+		if reason := h.checkRequestFreshness(req_id, timestamp); reason != "" {
+			replicationAuthFailed(c, username, reason)
 			return false, nil
 		}
-		hash_src := req_id + dev_id + digest + data.hw.String
-		ha := sha256.New()
-		ha.Write([]byte(hash_src))
-		calculated := base64.StdEncoding.EncodeToString(ha.Sum(nil))
-		if in_signature != calculated {
-			log.WithFields(log.Fields{
-				"proc": "ReplicationMiddlewareAuth",
-				"url":  c.Request().RequestURI,
-			}).Error("Request signature id did not match")
+
+		for i := range matched {
+			hash_src := req_id + dev_id + digest + timestamp + matched[i].Hw.String
+			ha := sha256.New()
+			ha.Write([]byte(hash_src))
+			calculated := base64.StdEncoding.EncodeToString(ha.Sum(nil))
+			if secureEqual(in_signature, calculated) {
+				credential = &matched[i]
+				break
+			}
+		}
+		if credential == nil {
+			replicationAuthFailed(c, username, "request signature did not match")
 			return false, nil
 		}
+
+		// Подпись верна, X-Request-Id больше не может быть использован. Старые платы могут его не передавать
+		if req_id != "" {
+			added, err := h.replicationNonceAdd(username, req_id, time.Now().Add(h.cfg.Signing.nonceTTL()))
+			if err != nil {
+				log.WithFields(log.Fields{
+					"username": username,
+					"error":    err,
+					"proc":     "ReplicationMiddlewareAuth",
+				}).Error("ReplicationMiddlewareAuth SQL error")
+				return false, err
+			}
+			if !added {
+				replicationAuthFailed(c, username, "request id reused")
+				return false, nil
+			}
+		}
+
+		c.Set("board_signed", true)
 	}
 
-	c.Set("club_id", data.club_id.Int32)
+	c.Set("club_id", credential.ClubId)
 	c.Set("board_id", username)
 
 	return true, nil
@@ -264,7 +283,8 @@ func (h *handler) replicationContractorGet(c jrpc.Context) error {
 
 func (h *handler) replicationRolesList(c jrpc.Context) error {
 	roles := []UserRolesRow{}
-	if err := h.DB.Select(&roles, `SELECT * FROM api_replication."listRoles"();`); err != nil {
+	result, err := h.replicationSelect(c, &roles, "listRoles", "roles")
+	if err != nil {
 		c.EchoContext().Echo().Logger.Errorj(map[string]interface{}{
 			"error":   err,
 			"proc":    "replicationRolesList",
@@ -272,14 +292,15 @@ func (h *handler) replicationRolesList(c jrpc.Context) error {
 		})
 		return err
 	}
-	return c.Result(roles)
+	return c.Result(result)
 }
 
 func (h *handler) replicationUserList(c jrpc.Context) error {
 	club_id := c.EchoContext().Get("club_id").(int32)
 
 	users := []UsersRow{}
-	if err := h.DB.Select(&users, `SELECT * FROM api_replication."listUsers"($1);`, club_id); err != nil {
+	result, err := h.replicationSelect(c, &users, "listUsers", "users", club_id)
+	if err != nil {
 
 		c.EchoContext().Echo().Logger.Errorj(map[string]interface{}{
 			"error":   err,
@@ -289,12 +310,13 @@ func (h *handler) replicationUserList(c jrpc.Context) error {
 
 		return err
 	}
-	return c.Result(users)
+	return c.Result(result)
 }
 
 func (h *handler) replicationRolePermissions(c jrpc.Context) error {
 	roles := []RolePermissionsRow{}
-	if err := h.DB.Select(&roles, `SELECT * FROM api_replication."listRolePermissions"();`); err != nil {
+	result, err := h.replicationSelect(c, &roles, "listRolePermissions", "roles.permissions")
+	if err != nil {
 		c.EchoContext().Echo().Logger.Errorj(map[string]interface{}{
 			"error":   err,
 			"proc":    "replicationRolePermissions",
@@ -302,14 +324,15 @@ func (h *handler) replicationRolePermissions(c jrpc.Context) error {
 		})
 		return err
 	}
-	return c.Result(roles)
+	return c.Result(result)
 }
 
 func (h *handler) replicationRoleMembership(c jrpc.Context) error {
 	club_id := c.EchoContext().Get("club_id").(int32)
 
 	roles := []RoleMembershipRow{}
-	if err := h.DB.Select(&roles, `SELECT * FROM api_replication."listMembership"($1);`, club_id); err != nil {
+	result, err := h.replicationSelect(c, &roles, "listMembership", "roles.membership", club_id)
+	if err != nil {
 		c.EchoContext().Echo().Logger.Errorj(map[string]interface{}{
 			"error":   err,
 			"proc":    "replicationRoleMembership",
@@ -317,7 +340,7 @@ func (h *handler) replicationRoleMembership(c jrpc.Context) error {
 		})
 		return err
 	}
-	return c.Result(roles)
+	return c.Result(result)
 }
 
 //############### Спорт ###################
@@ -337,6 +360,16 @@ func (h *handler) replicationClubGet(c jrpc.Context) error {
 		return errors.Wrap(err, "replicationClubGet Get error")
 	}
 
+	// По изменению logo_hash борт понимает, что логотип нужно скачать заново
+	if data.Params != nil {
+		var params ClubParams
+		if err := json.Unmarshal(*data.Params, &params); err == nil {
+			if logo_hash, ok := params["logo_hash"].(string); ok {
+				data.LogoHash = &logo_hash
+			}
+		}
+	}
+
 	return c.Result(data)
 }
 
@@ -344,7 +377,8 @@ func (h *handler) replicationTeamsList(c jrpc.Context) error {
 	club_id := c.EchoContext().Get("club_id").(int32)
 
 	data := []TeamsRow{}
-	if err := h.DB.Select(&data, `SELECT * FROM api_replication."listTeams"($1);`, club_id); err != nil {
+	result, err := h.replicationSelect(c, &data, "listTeams", "teams", club_id)
+	if err != nil {
 		c.EchoContext().Echo().Logger.Errorj(map[string]interface{}{
 			"error":   err,
 			"proc":    "replicationTeamsList",
@@ -352,14 +386,15 @@ func (h *handler) replicationTeamsList(c jrpc.Context) error {
 		})
 		return err
 	}
-	return c.Result(data)
+	return c.Result(result)
 }
 
 func (h *handler) replicationPositionsList(c jrpc.Context) error {
 	club_id := c.EchoContext().Get("club_id").(int32)
 
 	data := []PositionsRow{}
-	if err := h.DB.Select(&data, `SELECT * FROM api_replication."listPositions"($1);`, club_id); err != nil {
+	result, err := h.replicationSelect(c, &data, "listPositions", "positions", club_id)
+	if err != nil {
 		c.EchoContext().Echo().Logger.Errorj(map[string]interface{}{
 			"error":   err,
 			"proc":    "replicationTeamsList",
@@ -367,14 +402,15 @@ func (h *handler) replicationPositionsList(c jrpc.Context) error {
 		})
 		return err
 	}
-	return c.Result(data)
+	return c.Result(result)
 }
 
 func (h *handler) replicationPlayersList(c jrpc.Context) error {
 	club_id := c.EchoContext().Get("club_id").(int32)
 
 	data := []PlayersRow{}
-	if err := h.DB.Select(&data, `SELECT * FROM api_replication."listPlayers"($1);`, club_id); err != nil {
+	result, err := h.replicationSelect(c, &data, "listPlayers", "players", club_id)
+	if err != nil {
 		c.EchoContext().Echo().Logger.Errorj(map[string]interface{}{
 			"error":   err,
 			"proc":    "replicationPlayersList",
@@ -382,14 +418,15 @@ func (h *handler) replicationPlayersList(c jrpc.Context) error {
 		})
 		return err
 	}
-	return c.Result(data)
+	return c.Result(result)
 }
 
 func (h *handler) replicationFilesList(c jrpc.Context) error {
 	club_id := c.EchoContext().Get("club_id").(int32)
 
 	data := []FilesRow{}
-	if err := h.DB.Select(&data, `SELECT * FROM api_replication."listFiles"($1);`, club_id); err != nil {
+	result, err := h.replicationSelect(c, &data, "listFiles", "files", club_id)
+	if err != nil {
 		c.EchoContext().Echo().Logger.Errorj(map[string]interface{}{
 			"error":   err,
 			"proc":    "replicationPlayersList",
@@ -397,7 +434,18 @@ func (h *handler) replicationFilesList(c jrpc.Context) error {
 		})
 		return err
 	}
-	return c.Result(data)
+
+	// Копия, которую отдает replication/files/:id по умолчанию
+	for idx := range data {
+		var file_info FileInfo
+		if err := json.Unmarshal(data[idx].Data, &file_info); err != nil {
+			continue
+		}
+		if r, ok := file_info.Renditions[h.cfg.BoardRendition]; ok {
+			data[idx].Rendition = &r
+		}
+	}
+	return c.Result(result)
 }
 
 func (h *handler) replicationGetFile(c echo.Context) error {
@@ -416,21 +464,12 @@ func (h *handler) replicationGetFile(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	filepath := strings.TrimSuffix(h.cfg.FilesDir, "/") + "/" + file_info.FileData.FileSystemName
-	mime_type := file_info.FileData.MimeType
-
-	f, err := os.Open(filepath)
-	if err != nil {
-		c.Echo().Logger.Errorj(map[string]interface{}{
-			"error":    err,
-			"proc":     "replicationGetFile",
-			"filepath": filepath,
-			"message":  "Open file error",
-		})
-
-		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	size := c.QueryParam("size")
+	if size == "" {
+		size = h.cfg.BoardRendition
 	}
-	return c.Stream(http.StatusOK, mime_type, f)
+	r := file_info.FileData.rendition(size)
+	return h.serveStorageFile(c, r.FileSystemName, r.MimeType, r.Hash)
 }
 
 func (h *handler) replicationGetClubLogo(c echo.Context) error {
@@ -442,29 +481,18 @@ func (h *handler) replicationGetClubLogo(c echo.Context) error {
 		return errors.Wrap(err, "replicationGetClubLogo Get error")
 	}
 
-	filepath := strings.TrimSuffix(h.cfg.AssetsDir, "/") + "/404.png"
-	logo_mime := "image/png"
-
-	switch logo_path := club_info.Params["logo_path"].(type) {
-	case string:
-		filepath = strings.TrimSuffix(h.cfg.FilesDir, "/") + "/" + logo_path
-	}
-
-	switch mime := club_info.Params["logo_mime"].(type) {
-	case string:
-		logo_mime = mime
-	}
-
-	f, err := os.Open(filepath)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, err.Error())
-	}
-	return c.Stream(http.StatusOK, logo_mime, f)
+	return h.streamClubLogo(c, club_info.Params, "404.png")
 }
 
 // ############### Обратная репликация ###################
+/*
+Сохранение тренировки, рассчитанной платой. Каждая выгрузка получает ревизию и хэш содержимого:
+повтор той же выгрузки ничего не меняет, а выгрузка, основанная на устаревшей ревизии, отклоняется
+с описанием отличий. Содержимое каждой ревизии сохраняется для отката (admin events.rollback)
+*/
 func (h *handler) saveCalculatedEvent(c jrpc.Context) error {
 	club_id := c.EchoContext().Get("club_id").(int32)
+	board_id := c.EchoContext().Get("board_id").(string)
 
 	var params ReverseRequest
 
@@ -472,37 +500,125 @@ func (h *handler) saveCalculatedEvent(c jrpc.Context) error {
 		return errors.Wrap(err, "saveCalculatedEvent Bind error")
 	}
 
+	hash, err := params.contentHash()
+	if err != nil {
+		return errors.Wrap(err, "saveCalculatedEvent hash error")
+	}
+	// Журнал репликации хранит хэш содержимого, а не тела запроса с id и прочей обвязкой JSON-RPC
+	c.EchoContext().Set("payload_hash", hash)
+
+	result, err := h.storeCalculatedEvent(club_id, board_id, params, hash)
+	if err != nil {
+		return err
+	}
+	return c.Result(result)
+}
+
+/*
+Сохранение выгрузки платы, также используется для повтора выгрузки из журнала репликации.
+hash - contentHash выгрузки
+*/
+func (h *handler) storeCalculatedEvent(club_id int32, board_id string, params ReverseRequest, hash string) (interface{}, error) {
+	if err := h.checkReverseRequest(board_id, params); err != nil {
+		return nil, err
+	}
+	params.checkHash(board_id, hash)
+
 	TX, err := h.DB.Beginx()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 			"proc":  "saveCalculatedEvent",
 		}).Error("Beginx error")
-		return errors.Wrap(err, "Beginx error")
+		return nil, errors.Wrap(err, "Beginx error")
 	}
 
+	// Фиксируется только полностью записанная ревизия, повтор и конфликт ничего не меняют
+	committed := false
 	defer func(TX *sqlx.Tx) {
-		r := recover()
-		if r != nil {
-			if err = TX.Rollback(); err != nil {
-				log.WithFields(log.Fields{
-					"error": err,
-					"proc":  "saveCalculatedEvent defer",
-				}).Error("Rollback error")
-			}
-		} else {
-			if err = TX.Commit(); err != nil {
-				log.WithFields(log.Fields{
-					"error": err,
-					"proc":  "saveCalculatedEvent defer",
-				}).Error("Commit error")
-			}
+		if committed {
+			return
+		}
+		if err := TX.Rollback(); err != nil {
 			log.WithFields(log.Fields{
-				"proc": "saveCalculatedEvent defer",
-			}).Trace("Finished")
+				"error": err,
+				"proc":  "saveCalculatedEvent defer",
+			}).Error("Rollback error")
 		}
 	}(TX)
 
+	current, err := eventRevisionCurrent(TX, club_id, params.Event.Id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "saveCalculatedEvent",
+			"SQL":   "eventRevisionsCurrent",
+			"error": err,
+		}).Error("SQL error")
+		return nil, err
+	}
+
+	if current != nil && current.Hash == hash {
+		log.WithFields(log.Fields{
+			"proc":     "saveCalculatedEvent",
+			"event_id": params.Event.Id,
+			"revision": current.Revision,
+		}).Info("Duplicate event.save ignored")
+		return params.saveResult(current.Revision, hash, true), nil
+	}
+
+	if current != nil && params.Revision != nil && *params.Revision != current.Revision {
+		stored, err := eventRevisionPayload(TX, club_id, params.Event.Id, current.Revision)
+		if err != nil {
+			return nil, err
+		}
+		return nil, eventSaveConflict(current, *params.Revision, reverseRequestDiff(stored, params))
+	}
+
+	if current != nil && params.Revision == nil && current.foreign(board_id) {
+		stored, err := eventRevisionPayload(TX, club_id, params.Event.Id, current.Revision)
+		if err != nil {
+			return nil, err
+		}
+		if err := eventSaveOverwriteLog(TX, club_id, board_id, current, hash, reverseRequestDiff(stored, params)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := h.writeCalculatedEvent(TX, club_id, params); err != nil {
+		return nil, err
+	}
+
+	revision := int64(1)
+	if current != nil {
+		revision = current.Revision + 1
+	}
+	if err := eventRevisionAdd(TX, club_id, params, revision, hash, &board_id, nil); err != nil {
+		return nil, err
+	}
+
+	// Плата получает новую ревизию, только если она действительно записана.
+	// Транзакция завершается и при ошибке Commit, откатывать ее не нужно
+	committed = true
+	if err := TX.Commit(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"proc":  "saveCalculatedEvent",
+		}).Error("Commit error")
+		return nil, errors.Wrap(err, "Commit error")
+	}
+
+	h.boardEventSaved(club_id, board_id, params.Event.Id)
+	h.suggestMaxPulse(club_id, params)
+
+	return params.saveResult(revision, hash, false), nil
+}
+
+/*
+Запись данных тренировки в открытой транзакции. Прежние данные тренировки заменяются.
+Датчики, сплиты и показатели по умолчанию пишутся по одной строке, как раньше,
+при EVENT_SAVE_BULK=true - пакетами (writeEventRowsBulk)
+*/
+func (h *handler) writeCalculatedEvent(TX *sqlx.Tx, club_id int32, params ReverseRequest) error {
 	if _, err := TX.Exec(`select * from api_replication."prepareCalculatedEvent"($1, $2);`, club_id, params.Event.Id); err != nil {
 		log.WithFields(log.Fields{
 			"proc":  "saveCalculatedEvent",
@@ -527,6 +643,10 @@ func (h *handler) saveCalculatedEvent(c jrpc.Context) error {
 		return errors.Wrap(err, "SQL error")
 	}
 
+	if h.cfg.EventSave.Bulk {
+		return h.writeEventRowsBulk(TX, club_id, params)
+	}
+
 	for _, eventSensor := range params.EventSensors {
 		if _, err := TX.Exec(`select * from api_replication."eventsSetPlayerSensor"($1, $2, $3, $4);`,
 			club_id, eventSensor.EventId, eventSensor.PlayerID, eventSensor.SensorId); err != nil {
@@ -583,11 +703,10 @@ func (h *handler) saveCalculatedEvent(c jrpc.Context) error {
 		}
 	}
 
-	return c.Result(true)
-
+	return nil
 }
 
-func (h *handler) uploadFile(c echo.Context, path string) error {
+func (h *handler) uploadFile(c echo.Context, kind string) error {
 	club_id := c.Get("club_id").(int32)
 	board_id := c.Get("board_id").(string)
 
@@ -611,35 +730,17 @@ func (h *handler) uploadFile(c echo.Context, path string) error {
 	}
 	defer src.Close()
 
-	newDirPath := strings.TrimSuffix(h.cfg.FilesDir, "/") + "/" + path + "/" + strconv.Itoa(int(club_id)) + "/" + board_id
-	err = os.MkdirAll(newDirPath, os.ModePerm)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"proc":  "uploadLogFile",
-			"error": err,
-		}).Error("MkdirAll error")
-
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	// Тренировка, к которой относится файл, если плата ее передала
+	var event_id *string
+	if event := c.FormValue("event_id"); event != "" {
+		event_id = &event
 	}
 
-	newFilePath := newDirPath + "/" + file.Filename
-
-	dst, err := os.Create(newFilePath)
-	if err != nil {
+	if _, err := h.storeBoardUpload(c.Request().Context(), club_id, board_id, kind, file.Filename, src, file.Size, file.Header.Get("Content-Type"), event_id); err != nil {
 		log.WithFields(log.Fields{
 			"proc":  "uploadLogFile",
 			"error": err,
-		}).Error("Create error")
-
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-	}
-	defer dst.Close()
-
-	if _, err = io.Copy(dst, src); err != nil {
-		log.WithFields(log.Fields{
-			"proc":  "uploadLogFile",
-			"error": err,
-		}).Error("Copy error")
+		}).Error("Store error")
 
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -648,55 +749,32 @@ func (h *handler) uploadFile(c echo.Context, path string) error {
 }
 
 func (h *handler) uploadLogFile(c echo.Context) error {
-	return h.uploadFile(c, "logs")
+	return h.uploadFile(c, UploadKindLogs)
 }
 
 func (h *handler) uploadRawFile(c echo.Context) error {
-	return h.uploadFile(c, "raw")
+	return h.uploadFile(c, UploadKindRaw)
 }
 
-func (h *handler) replicationGetCompose(c echo.Context) error {
-	club_id := c.Get("club_id").(int32)
-	board_id := c.Get("board_id").(string)
-
-	filePath1 := strings.TrimSuffix(h.cfg.FilesDir, "/") + "/update"
-	filePath2 := strings.TrimSuffix(h.cfg.FilesDir, "/") + "/update/" + strconv.Itoa(int(club_id))
-	filePath3 := strings.TrimSuffix(h.cfg.FilesDir, "/") + "/update/" + strconv.Itoa(int(club_id)) + "/" + board_id
-
-	var composePath string
-	if _, err := os.Stat(filePath3 + "/docker-compose.yml"); err == nil {
-		composePath = filePath3 + "/docker-compose.yml"
-	} else if _, err := os.Stat(filePath2 + "/docker-compose.yml"); err == nil {
-		composePath = filePath2 + "/docker-compose.yml"
-	} else if _, err := os.Stat(filePath1 + "/docker-compose.yml"); err == nil {
-		composePath = filePath1 + "/docker-compose.yml"
-	} else {
-		return echo.NewHTTPError(http.StatusNotFound, "file not found")
-	}
-
-	f, err := os.Open(composePath)
-
-	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+/*
+Проверка связи. Плата может передать свое состояние, оно сохраняется в реестре плат
+*/
+func (h *handler) replicationPing(c jrpc.Context) error {
+	var params struct {
+		FreeDisk       *int64 `json:"free_disk"`
+		PendingUploads *int32 `json:"pending_uploads"`
 	}
 
-	return c.Stream(http.StatusOK, "application/yml", f)
-}
+	// Старые платы вызывают ping без параметров
+	_ = c.Bind(&params)
 
-func (h *handler) replicationPing(c jrpc.Context) error {
-	club_id := c.EchoContext().Get("club_id").(int32)
-	board_id := c.EchoContext().Get("board_id").(string)
+	h.boardSeen(c.EchoContext(), params.FreeDisk, params.PendingUploads)
 
 	log.WithFields(log.Fields{
 		"proc":     "replicationPing",
-		"club_id":  club_id,
-		"board_id": board_id,
-	}).Error("Board is up")
+		"club_id":  c.EchoContext().Get("club_id").(int32),
+		"board_id": c.EchoContext().Get("board_id").(string),
+	}).Debug("Board is up")
 
 	return c.Result(true)
 }
-
-func (h *handler) portableStub(c jrpc.Context) error {
-
-	return c.Result(false)
-}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+)
+
+/*
+Изменения справочника с курсора since. Deleted - ключи удаленных строк в том виде,
+в котором их возвращает listTombstones (например {"id": 5}). Full=true означает полную выгрузку:
+курсор не передан пустым или старше хранимой истории удалений, и плата должна заменить справочник целиком
+*/
+type ReplicationChanges struct {
+	Items   interface{}       `json:"items"`
+	Deleted []json.RawMessage `json:"deleted"`
+	Cursor  string            `json:"cursor"`
+	Full    bool              `json:"full"`
+}
+
+/*
+Выборка справочника для платы. Без параметра since возвращается весь справочник, как раньше.
+С since вызывается процедура <proc>Since с дополнительным параметром курсора и в ответе
+только измененные строки, удаления и новый курсор.
+Курсор снимается до выборки, поэтому изменения во время выборки придут и при следующей синхронизации
+*/
+func (h *handler) replicationSelect(c jrpc.Context, dest interface{}, proc string, list string, args ...interface{}) (interface{}, error) {
+	var params struct {
+		Since *string `json:"since"`
+	}
+
+	// Старые платы вызывают методы без параметров
+	_ = c.Bind(&params)
+
+	if params.Since == nil {
+		if err := h.DB.Select(dest, replicationQuery(proc, len(args)), args...); err != nil {
+			return nil, errors.Wrap(err, proc+" SQL error")
+		}
+		return dest, nil
+	}
+
+	var since int64
+	if *params.Since != "" {
+		var err error
+		if since, err = strconv.ParseInt(*params.Since, 10, 64); err != nil || since < 0 {
+			return nil, ErrorInvalidCursor
+		}
+	}
+
+	var cursor, horizon int64
+	if err := h.DB.QueryRow(`select * from api_replication."changeCursor"();`).Scan(&cursor, &horizon); err != nil {
+		return nil, errors.Wrap(err, "changeCursor SQL error")
+	}
+
+	changes := &ReplicationChanges{
+		Items:   dest,
+		Deleted: []json.RawMessage{},
+		Cursor:  strconv.FormatInt(cursor, 10),
+		Full:    since == 0 || since < horizon,
+	}
+	if changes.Full {
+		since = 0
+	}
+
+	if err := h.DB.Select(dest, replicationQuery(proc+"Since", len(args)+1), append(args, since)...); err != nil {
+		return nil, errors.Wrap(err, proc+"Since SQL error")
+	}
+
+	if !changes.Full {
+		club_id := c.EchoContext().Get("club_id").(int32)
+		if err := h.DB.Select(&changes.Deleted, `select * from api_replication."listTombstones"($1, $2, $3);`, club_id, list, since); err != nil {
+			return nil, errors.Wrap(err, "listTombstones SQL error")
+		}
+	}
+
+	return changes, nil
+}
+
+func replicationQuery(proc string, args int) string {
+	placeholders := make([]string, args)
+	for i := range placeholders {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+	}
+	return fmt.Sprintf(`SELECT * FROM api_replication."%s"(%s);`, proc, strings.Join(placeholders, ", "))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type cfgSigning struct {
+	// Допустимое расхождение X-Timestamp платы и часов сервера
+	Skew time.Duration `env:"REPLICATION_SIGN_SKEW" envDefault:"5m"`
+	// Требовать X-Content-Digest, X-Timestamp и X-Request-Id от плат с аппаратным ключом. Пока false,
+	// старые платы без них работают, но запрос без X-Timestamp можно повторить, когда X-Request-Id забыт
+	Strict bool `env:"REPLICATION_SIGN_STRICT" envDefault:"false"`
+	// Тело запроса больше этого размера при проверке X-Content-Digest буферизуется во временный файл
+	DigestMemory int64 `env:"REPLICATION_DIGEST_MEMORY" envDefault:"8388608"`
+}
+
+/*
+Сколько помнить X-Request-Id. Запрос с X-Timestamp вне окна Skew отклоняется, поэтому двух окон
+расхождения достаточно, чтобы повтор был отклонен тем или другим способом
+*/
+func (cfg cfgSigning) nonceTTL() time.Duration {
+	return 2 * cfg.Skew
+}
+
+const (
+	headerRequestId     = "X-Request-Id"
+	headerDeviceId      = "X-Device-Id"
+	headerContentDigest = "X-Content-Digest"
+	headerTimestamp     = "X-Timestamp"
+	headerSignature     = "X-Signature"
+)
+
+// Значения заголовка, склеенные в одну строку, как их подписывает плата
+func headerJoined(req *http.Request, name string) string {
+	return strings.Join(req.Header.Values(name), "")
+}
+
+// Сравнение секретов за время, не зависящее от совпавшего префикса
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Причина отказа пишется в лог без пароля и подписи
+func replicationAuthFailed(c echo.Context, username string, reason string) {
+	log.WithFields(log.Fields{
+		"proc":       "ReplicationMiddlewareAuth",
+		"username":   username,
+		"url":        c.Request().RequestURI,
+		"request_id": c.Request().Header.Get(headerRequestId),
+		"ip":         c.RealIP(),
+	}).Error("ReplicationMiddlewareAuth " + reason)
+}
+
+/*
+Проверка X-Timestamp (unix-время в секундах) и наличия X-Request-Id подписанного запроса.
+Возвращает причину отказа или пустую строку. Переданное время всегда должно быть в окне Skew,
+а обязательны оба заголовка только при REPLICATION_SIGN_STRICT: старые платы их не передают
+*/
+func (h *handler) checkRequestFreshness(req_id string, timestamp string) string {
+	if timestamp == "" && h.cfg.Signing.Strict {
+		return "request timestamp missing"
+	}
+	if req_id == "" && h.cfg.Signing.Strict {
+		return "request id missing"
+	}
+	if timestamp == "" {
+		return ""
+	}
+
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "request timestamp malformed"
+	}
+	skew := time.Since(time.Unix(sec, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > h.cfg.Signing.Skew {
+		return "request timestamp out of window"
+	}
+	return ""
+}
+
+/*
+Запоминает X-Request-Id платы до expires. Использованные id хранятся в БД с уникальным ключом
+(board_id, request_id), поэтому повтор отклоняется, на какой бы экземпляр API он ни пришел.
+false - id уже использован
+*/
+func (h *handler) replicationNonceAdd(board_id string, req_id string, expires time.Time) (bool, error) {
+	var added bool
+	if err := h.DB.Get(&added, `select * from api_replication."replicationNoncesAdd"($1, $2, $3);`, board_id, req_id, expires); err != nil {
+		return false, errors.Wrap(err, "replicationNoncesAdd SQL error")
+	}
+	return added, nil
+}
+
+// Периодическое удаление X-Request-Id, срок хранения которых истек
+func (h *handler) runNoncesCleanup(ctx context.Context) {
+	ttl := h.cfg.Signing.nonceTTL()
+	if ttl <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := h.DB.Exec(`select * from api_replication."replicationNoncesExpire"($1);`, time.Now()); err != nil {
+			log.WithFields(log.Fields{
+				"proc":  "runNoncesCleanup",
+				"error": err,
+			}).Error("SQL error")
+		}
+	}
+}
+
+/*
+Разбор X-Content-Digest: SHA-256 тела в base64 или hex, с префиксом "sha-256=" или без него.
+nil, если формат не распознан
+*/
+func parseContentDigest(value string) []byte {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, "="); i > 0 && i < len(value)-2 {
+		if alg := strings.ToLower(value[:i]); alg == "sha-256" || alg == "sha256" {
+			value = value[i+1:]
+		}
+	}
+
+	if sum, err := hex.DecodeString(value); err == nil && len(sum) == sha256.Size {
+		return sum
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if sum, err := enc.DecodeString(value); err == nil && len(sum) == sha256.Size {
+			return sum
+		}
+	}
+	return nil
+}
+
+/*
+Читает тело запроса, считая SHA-256, и подменяет его копией: в памяти или во временном файле,
+если тело больше max_mem. cleanup удаляет временный файл
+*/
+func hashRequestBody(req *http.Request, max_mem int64) (sum []byte, cleanup func(), err error) {
+	cleanup = func() {}
+	if req.Body == nil || req.Body == http.NoBody {
+		empty := sha256.Sum256(nil)
+		return empty[:], cleanup, nil
+	}
+	defer req.Body.Close()
+
+	ha := sha256.New()
+	var buf bytes.Buffer
+	n, err := io.CopyN(io.MultiWriter(ha, &buf), req.Body, max_mem+1)
+	if err != nil && err != io.EOF {
+		return nil, cleanup, err
+	}
+	if n <= max_mem {
+		req.Body = io.NopCloser(bytes.NewReader(buf.Bytes()))
+		return ha.Sum(nil), cleanup, nil
+	}
+
+	tmp, err := os.CreateTemp("", "replication-body-*")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	if _, err := io.Copy(io.MultiWriter(ha, tmp), req.Body); err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	req.Body = io.NopCloser(tmp)
+	return ha.Sum(nil), cleanup, nil
+}
+
+/*
+Проверка X-Content-Digest по телу запроса. Ставится после BasicAuth: для подписанных запросов
+заголовок защищен подписью, и подмена тела при повторе запроса обнаруживается здесь.
+Без заголовка в строгом режиме тело должно быть пустым, иначе проверка пропускается (старые платы)
+*/
+func (h *handler) ReplicationVerifyDigest(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if signed, _ := c.Get("board_signed").(bool); !signed {
+			return next(c)
+		}
+
+		req := c.Request()
+		value := headerJoined(req, headerContentDigest)
+		if value == "" && !h.cfg.Signing.Strict {
+			return next(c)
+		}
+
+		sum, cleanup, err := hashRequestBody(req, h.cfg.Signing.DigestMemory)
+		defer cleanup()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"proc":  "ReplicationVerifyDigest",
+				"url":   req.RequestURI,
+				"error": err,
+			}).Error("Read body error")
+			return echo.NewHTTPError(http.StatusBadRequest, "request body read error")
+		}
+
+		var expected []byte
+		if value == "" {
+			empty := sha256.Sum256(nil)
+			expected = empty[:]
+		} else {
+			expected = parseContentDigest(value)
+		}
+
+		if expected == nil || subtle.ConstantTimeCompare(expected, sum) != 1 {
+			log.WithFields(log.Fields{
+				"proc":       "ReplicationVerifyDigest",
+				"board_id":   c.Get("board_id"),
+				"url":        req.RequestURI,
+				"request_id": req.Header.Get(headerRequestId),
+			}).Error("Content digest did not match")
+			return echo.NewHTTPError(http.StatusUnauthorized, "content digest mismatch")
+		}
+
+		return next(c)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+/*
+БД для тестов проверки плат: отвечает на getBoardCredentials и replicationNoncesAdd из памяти.
+Уникальность X-Request-Id проверяется так же, как уникальным ключом в БД
+*/
+type authTestDB struct {
+	mu          sync.Mutex
+	credentials map[string][]BoardCredential
+	nonces      map[string]bool
+}
+
+func (db *authTestDB) Connect(context.Context) (driver.Conn, error) { return authTestConn{db}, nil }
+func (db *authTestDB) Driver() driver.Driver                        { return nil }
+
+type authTestConn struct{ db *authTestDB }
+
+func (c authTestConn) Prepare(query string) (driver.Stmt, error) {
+	return authTestStmt{db: c.db, query: query}, nil
+}
+func (c authTestConn) Close() error              { return nil }
+func (c authTestConn) Begin() (driver.Tx, error) { return nil, driver.ErrSkip }
+
+type authTestStmt struct {
+	db    *authTestDB
+	query string
+}
+
+func (s authTestStmt) Close() error                               { return nil }
+func (s authTestStmt) NumInput() int                              { return -1 }
+func (s authTestStmt) Exec([]driver.Value) (driver.Result, error) { return driver.ResultNoRows, nil }
+
+func (s authTestStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	switch {
+	case strings.Contains(s.query, `"getBoardCredentials"`):
+		rows := &authTestRows{columns: []string{"secret", "club_id", "hw", "revoked"}}
+		for _, cr := range s.db.credentials[args[0].(string)] {
+			var hw driver.Value
+			if cr.Hw.Valid {
+				hw = cr.Hw.String
+			}
+			rows.values = append(rows.values, []driver.Value{cr.Secret, int64(cr.ClubId), hw, cr.Revoked})
+		}
+		return rows, nil
+	case strings.Contains(s.query, `"replicationNoncesAdd"`):
+		key := args[0].(string) + "/" + args[1].(string)
+		added := !s.db.nonces[key]
+		s.db.nonces[key] = true
+		return &authTestRows{columns: []string{"replicationNoncesAdd"}, values: [][]driver.Value{{added}}}, nil
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+type authTestRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *authTestRows) Columns() []string { return r.columns }
+func (r *authTestRows) Close() error      { return nil }
+
+func (r *authTestRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func hwKey(hw string) sql.NullString {
+	return sql.NullString{String: hw, Valid: true}
+}
+
+func newAuthTestHandler() *handler {
+	db := &authTestDB{
+		credentials: map[string][]BoardCredential{
+			// Ротация: текущая пара и прежняя на время перекрытия
+			"board-1": {
+				{Secret: "secret-new", ClubId: 7, Hw: hwKey("hw-new")},
+				{Secret: "secret-old", ClubId: 7, Hw: hwKey("hw-old")},
+			},
+			// Старая плата без аппаратного ключа
+			"board-legacy": {
+				{Secret: "secret-legacy", ClubId: 8},
+			},
+			// Выдача аппаратного ключа: прежняя пара без ключа еще действует
+			"board-mixed": {
+				{Secret: "secret-hw", ClubId: 9, Hw: hwKey("hw-mixed")},
+				{Secret: "secret-plain", ClubId: 9},
+			},
+			"board-revoked": {
+				{Secret: "secret-revoked", ClubId: 10, Hw: hwKey("hw-revoked")},
+				{Secret: "secret-revoked-old", ClubId: 10, Revoked: true},
+			},
+		},
+		nonces: map[string]bool{},
+	}
+
+	return &handler{
+		DB: sqlx.NewDb(sql.OpenDB(db), "postgres"),
+		// Тело больше 1 КБ при проверке X-Content-Digest уходит во временный файл
+		cfg: Config{Signing: cfgSigning{Skew: 5 * time.Minute, DigestMemory: 1024}},
+	}
+}
+
+func contentDigest(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Запрос платы. Пустые заголовки не передаются, подпись считается по hw, если не задана явно
+type signedRequest struct {
+	board     string
+	password  string
+	hw        string
+	deviceId  string
+	requestId string
+	timestamp string
+	digest    string
+	signature string
+	body      string
+}
+
+func (r signedRequest) sign() string {
+	sum := sha256.Sum256([]byte(r.requestId + r.deviceId + r.digest + r.timestamp + r.hw))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (r signedRequest) request() *http.Request {
+	req := httptest.NewRequest("POST", "/replication", strings.NewReader(r.body))
+	req.SetBasicAuth(r.board, r.password)
+	set := func(name, value string) {
+		if value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	set(headerDeviceId, r.deviceId)
+	set(headerRequestId, r.requestId)
+	set(headerTimestamp, r.timestamp)
+	set(headerContentDigest, r.digest)
+	if r.signature != "" {
+		set(headerSignature, r.signature)
+	} else if r.hw != "" {
+		set(headerSignature, r.sign())
+	}
+	return req
+}
+
+// Ответ цепочки BasicAuth и ReplicationVerifyDigest, как на маршрутах репликации, и контекст обработчика
+type authTestResult struct {
+	status  int
+	body    string
+	signed  bool
+	club_id int32
+	board   string
+}
+
+func (h *handler) authTestServe(r signedRequest) authTestResult {
+	var result authTestResult
+
+	e := echo.New()
+	e.POST("/replication", func(c echo.Context) error {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		result.body = string(body)
+		result.signed, _ = c.Get("board_signed").(bool)
+		result.club_id, _ = c.Get("club_id").(int32)
+		result.board, _ = c.Get("board_id").(string)
+		return c.NoContent(http.StatusOK)
+	}, middleware.BasicAuth(h.ReplicationMiddlewareAuth), h.ReplicationVerifyDigest)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, r.request())
+	result.status = rec.Code
+	return result
+}
+
+func TestReplicationMiddlewareAuth(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	large := `{"data":"` + strings.Repeat("x", 64*1024) + `"}`
+
+	signed := func(board, password, hw, req_id string) signedRequest {
+		return signedRequest{board: board, password: password, hw: hw, deviceId: board, requestId: req_id, timestamp: now, digest: contentDigest("{}"), body: "{}"}
+	}
+	with := func(r signedRequest, change func(r *signedRequest)) signedRequest {
+		change(&r)
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		req     signedRequest
+		strict  bool
+		repeat  bool
+		status  int
+		signed  bool
+		club_id int32
+	}{
+		{name: "good signature", req: signed("board-1", "secret-new", "hw-new", "r-1"), status: http.StatusOK, signed: true, club_id: 7},
+		{name: "good signature, strict", req: signed("board-1", "secret-new", "hw-new", "r-1s"), strict: true, status: http.StatusOK, signed: true, club_id: 7},
+		{name: "rotation overlap, previous pair", req: signed("board-1", "secret-old", "hw-old", "r-2"), status: http.StatusOK, signed: true, club_id: 7},
+		{name: "rotation overlap, secret and hw from different pairs", req: signed("board-1", "secret-old", "hw-new", "r-3"), status: http.StatusUnauthorized},
+		{name: "bad signature", req: with(signed("board-1", "secret-new", "hw-new", "r-4"), func(r *signedRequest) {
+			r.signature = "bm90IGEgc2lnbmF0dXJl"
+		}), status: http.StatusUnauthorized},
+		{name: "signature without hw", req: signed("board-1", "secret-new", "", "r-5"), status: http.StatusUnauthorized},
+		{name: "replay", req: signed("board-1", "secret-new", "hw-new", "r-6"), repeat: true, status: http.StatusUnauthorized},
+		{name: "timestamp out of window", req: with(signed("board-1", "secret-new", "hw-new", "r-7"), func(r *signedRequest) {
+			r.timestamp = stale
+		}), status: http.StatusUnauthorized},
+		{name: "timestamp missing, old firmware", req: with(signed("board-1", "secret-new", "hw-new", "r-8"), func(r *signedRequest) {
+			r.timestamp = ""
+		}), status: http.StatusOK, signed: true, club_id: 7},
+		{name: "timestamp missing, strict", req: with(signed("board-1", "secret-new", "hw-new", "r-8s"), func(r *signedRequest) {
+			r.timestamp = ""
+		}), strict: true, status: http.StatusUnauthorized},
+		{name: "request id missing, old firmware", req: signed("board-1", "secret-new", "hw-new", ""), status: http.StatusOK, signed: true, club_id: 7},
+		{name: "request id missing, strict", req: signed("board-1", "secret-new", "hw-new", ""), strict: true, status: http.StatusUnauthorized},
+		{name: "device id of another board", req: with(signed("board-1", "secret-new", "hw-new", "r-9"), func(r *signedRequest) {
+			r.deviceId = "board-legacy"
+		}), status: http.StatusUnauthorized},
+		{name: "wrong password", req: signed("board-1", "secret-legacy", "hw-new", "r-10"), status: http.StatusUnauthorized},
+		{name: "unknown board", req: signed("board-unknown", "secret-new", "hw-new", "r-11"), status: http.StatusUnauthorized},
+		{name: "legacy board without signature", req: signedRequest{board: "board-legacy", password: "secret-legacy", body: "{}"}, status: http.StatusOK, club_id: 8},
+		{name: "hw issued, previous pair without hw", req: signedRequest{board: "board-mixed", password: "secret-plain", body: "{}"}, status: http.StatusUnauthorized},
+		{name: "hw issued, signed with new pair", req: signed("board-mixed", "secret-hw", "hw-mixed", "r-12"), status: http.StatusOK, signed: true, club_id: 9},
+		{name: "revoked in previous pair", req: signed("board-revoked", "secret-revoked", "hw-revoked", "r-13"), status: http.StatusUnauthorized},
+
+		// X-Content-Digest подписан вместе с заголовками, ReplicationVerifyDigest сверяет его с телом
+		{name: "digest does not match body", req: with(signed("board-1", "secret-new", "hw-new", "r-20"), func(r *signedRequest) {
+			r.body = `{"splits":[]}`
+		}), status: http.StatusUnauthorized},
+		{name: "digest missing, old firmware", req: with(signed("board-1", "secret-new", "hw-new", "r-21"), func(r *signedRequest) {
+			r.digest = ""
+		}), status: http.StatusOK, signed: true, club_id: 7},
+		{name: "digest missing, strict", req: with(signed("board-1", "secret-new", "hw-new", "r-22"), func(r *signedRequest) {
+			r.digest = ""
+		}), strict: true, status: http.StatusUnauthorized},
+		{name: "digest missing, strict, empty body", req: with(signed("board-1", "secret-new", "hw-new", "r-23"), func(r *signedRequest) {
+			r.digest, r.body = "", ""
+		}), strict: true, status: http.StatusOK, signed: true, club_id: 7},
+		{name: "digest malformed", req: with(signed("board-1", "secret-new", "hw-new", "r-24"), func(r *signedRequest) {
+			r.digest = "sha-256=not-a-digest"
+		}), status: http.StatusUnauthorized},
+		{name: "digest in hex", req: with(signed("board-1", "secret-new", "hw-new", "r-25"), func(r *signedRequest) {
+			sum := sha256.Sum256([]byte(r.body))
+			r.digest = hex.EncodeToString(sum[:])
+		}), status: http.StatusOK, signed: true, club_id: 7},
+		{name: "body above digest memory goes through temp file", req: with(signed("board-1", "secret-new", "hw-new", "r-26"), func(r *signedRequest) {
+			r.body, r.digest = large, contentDigest(large)
+		}), status: http.StatusOK, signed: true, club_id: 7},
+		{name: "body above digest memory, digest does not match", req: with(signed("board-1", "secret-new", "hw-new", "r-27"), func(r *signedRequest) {
+			r.body, r.digest = large, contentDigest(large+" ")
+		}), status: http.StatusUnauthorized},
+	}
+
+	h := newAuthTestHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.cfg.Signing.Strict = tt.strict
+
+			if tt.repeat {
+				if result := h.authTestServe(tt.req); result.status != http.StatusOK {
+					t.Fatalf("first request: status %d", result.status)
+				}
+			}
+
+			result := h.authTestServe(tt.req)
+			if result.status != tt.status {
+				t.Fatalf("status %d, want %d", result.status, tt.status)
+			}
+			if result.status != http.StatusOK {
+				return
+			}
+
+			if result.body != tt.req.body {
+				t.Errorf("handler got %d bytes of body, want %d", len(result.body), len(tt.req.body))
+			}
+			if result.signed != tt.signed {
+				t.Errorf("board_signed=%v, want %v", result.signed, tt.signed)
+			}
+			if result.club_id != tt.club_id {
+				t.Errorf("club_id=%v, want %v", result.club_id, tt.club_id)
+			}
+			if result.board != tt.req.board {
+				t.Errorf("board_id=%q, want %q", result.board, tt.req.board)
+			}
+		})
+	}
+}
+
+func TestCheckRequestFreshness(t *testing.T) {
+	unix := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+	}
+
+	tests := []struct {
+		name      string
+		strict    bool
+		req_id    string
+		timestamp string
+		reason    string
+	}{
+		{"now", false, "r", unix(0), ""},
+		{"within skew behind", false, "r", unix(-4 * time.Minute), ""},
+		{"within skew ahead", false, "r", unix(4 * time.Minute), ""},
+		{"behind skew", false, "r", unix(-6 * time.Minute), "request timestamp out of window"},
+		{"ahead of skew", false, "r", unix(6 * time.Minute), "request timestamp out of window"},
+		{"timestamp malformed", false, "r", "yesterday", "request timestamp malformed"},
+		{"timestamp missing", false, "r", "", ""},
+		{"request id missing", false, "", unix(0), ""},
+		{"strict, now", true, "r", unix(0), ""},
+		{"strict, behind skew", true, "r", unix(-6 * time.Minute), "request timestamp out of window"},
+		{"strict, timestamp missing", true, "r", "", "request timestamp missing"},
+		{"strict, request id missing", true, "", unix(0), "request id missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handler{cfg: Config{Signing: cfgSigning{Skew: 5 * time.Minute, Strict: tt.strict}}}
+			if reason := h.checkRequestFreshness(tt.req_id, tt.timestamp); reason != tt.reason {
+				t.Fatalf("reason=%q, want %q", reason, tt.reason)
+			}
+		})
+	}
+}
@@ -260,7 +260,7 @@ func (h *handler) reportFetchData(c jrpc.Context) (split_data []DBReportRecord,
 	if err := h.DB.Select(&split_data, queryReportGetData, club_id, pq.StringArray(params.EventIds), pq.StringArray(params.SplitIds)); err != nil {
 		return nil, errors.Wrap(err, "reportFetchData SQL error")
 	}
-	return split_data, nil
+	return filterPlayerReportData(claimsPlayerID(claims), split_data), nil
 }
 
 // вернуть данные по сплитам для переданного евента
@@ -281,7 +281,7 @@ func (h *handler) reportFetchDataEvent(c jrpc.Context) (split_data []DBReportRec
 	if err := h.DB.Select(&split_data, queryReportGetData, club_id, pq.StringArray(parr), pq.StringArray(sarr)); err != nil {
 		return nil, errors.Wrap(err, "reportFetchDataEvent SQL error")
 	}
-	return split_data, nil
+	return filterPlayerReportData(claimsPlayerID(claims), split_data), nil
 }
 
 // вернуть данные по опроснику эвента для переданного евента
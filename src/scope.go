@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/mrFokin/jrpc"
+)
+
+/*
+Игрок, от имени которого выполнен запрос. Для сотрудников клуба возвращает nil.
+player_id попадает в claims при выдаче токена (см. getClaims)
+*/
+func claimsPlayerID(claims *UserClaims) *int32 {
+	switch id := claims.Data["player_id"].(type) {
+	case float64:
+		player_id := int32(id)
+		return &player_id
+	}
+	return nil
+}
+
+// Клуб пользователя из claims. Токен без club_id не дает доступа к данным клубов
+func claimsClubID(claims *UserClaims) (*int32, error) {
+	id, ok := claims.Data["club_id"].(float64)
+	if !ok {
+		return nil, ErrorForbidden
+	}
+	club_id := int32(id)
+	return &club_id, nil
+}
+
+func (h *handler) requestPlayerID(c jrpc.Context) *int32 {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+	return claimsPlayerID(claims)
+}
+
+// Запрещает вызов метода с токеном игрока
+func (h *handler) staffOnly(next jrpc.HandlerFunc) jrpc.HandlerFunc {
+	return func(c jrpc.Context) error {
+		if h.requestPlayerID(c) != nil {
+			return ErrorForbidden
+		}
+		return next(c)
+	}
+}
+
+// Для токена игрока оставляет в выборке только строки этого игрока
+func filterPlayerReportData(player_id *int32, data []DBReportRecord) []DBReportRecord {
+	if player_id == nil {
+		return data
+	}
+
+	filtered := make([]DBReportRecord, 0, len(data))
+	for _, row := range data {
+		if row.PlayerID == *player_id {
+			filtered = append(filtered, row)
+		}
+	}
+	return filtered
+}
+
+// Пропускает только сотрудников поддержки с разрешением PermissionAdmin
+func (h *handler) AdminValidator(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := c.Get("user").(*jwt.Token).Claims.(*UserClaims)
+		if !h.doCheckPermission(claims.Permissions, PermissionAdmin) {
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrStorageNotFound = errors.New("storage: object not found")
+
+type cfgStorage struct {
+	Type      string       `env:"STORAGE_TYPE" envDefault:"local"`
+	Endpoint  string       `env:"S3_ENDPOINT"`
+	Region    string       `env:"S3_REGION"`
+	Bucket    string       `env:"S3_BUCKET" envDefault:"bsight"`
+	AccessKey secretString `env:"S3_ACCESS_KEY"`
+	SecretKey secretString `env:"S3_SECRET_KEY"`
+	UseSSL    bool         `env:"S3_USE_SSL" envDefault:"true"`
+}
+
+// Ключ доступа: при выводе конфигурации в лог значение скрывается
+type secretString string
+
+func (s secretString) String() string {
+	if s == "" {
+		return ""
+	}
+	return "******"
+}
+
+// Метаданные объекта в хранилище
+type StorageObject struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	MimeType string    `json:"type"`
+}
+
+// Открытый на чтение объект. Поддерживает Seek для отдачи диапазонов
+type StorageReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+/*
+Хранилище файлов: фото игроков, логотипы клубов, логи и сырые данные датчиков, файлы обновлений.
+Имена объектов - пути через "/" относительно корня хранилища
+*/
+type FileStorage interface {
+	Put(ctx context.Context, name string, r io.Reader, size int64, mime_type string) error
+	Get(ctx context.Context, name string) (StorageReader, *StorageObject, error)
+	Stat(ctx context.Context, name string) (*StorageObject, error)
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context, prefix string) ([]StorageObject, error)
+}
+
+func newFileStorage(cfg Config) (FileStorage, error) {
+	switch cfg.Storage.Type {
+	case "local", "":
+		return newLocalStorage(cfg.FilesDir), nil
+	case "s3":
+		return newS3Storage(cfg.Storage)
+	}
+	return nil, errors.New("unknown STORAGE_TYPE " + cfg.Storage.Type)
+}
+
+// Приводит имя объекта к виду "a/b/c" без выходов за пределы корня хранилища
+func storageName(parts ...string) string {
+	return strings.TrimPrefix(path.Clean("/"+path.Join(parts...)), "/")
+}
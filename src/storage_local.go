@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Хранилище в каталоге локальной файловой системы (FILES_PATH)
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) *localStorage {
+	return &localStorage{root: strings.TrimSuffix(root, "/")}
+}
+
+func (s *localStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(storageName(name)))
+}
+
+func (s *localStorage) object(name string, info os.FileInfo) *StorageObject {
+	return &StorageObject{
+		Name:     storageName(name),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		MimeType: mime.TypeByExtension(path.Ext(name)),
+	}
+}
+
+// Запись идет во временный файл рядом с целевым, затем он переименовывается. Читатели не видят недописанный файл
+func (s *localStorage) Put(ctx context.Context, name string, r io.Reader, size int64, mime_type string) error {
+	filename := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return errors.Wrap(err, "localStorage MkdirAll error")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".upload-")
+	if err != nil {
+		return errors.Wrap(err, "localStorage TempFile error")
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "localStorage Copy error")
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "localStorage Close error")
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "localStorage Rename error")
+	}
+	return nil
+}
+
+func (s *localStorage) Get(ctx context.Context, name string) (StorageReader, *StorageObject, error) {
+	f, err := os.Open(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, nil, ErrStorageNotFound
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "localStorage Open error")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "localStorage Stat error")
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, nil, ErrStorageNotFound
+	}
+
+	return f, s.object(name, info), nil
+}
+
+func (s *localStorage) Stat(ctx context.Context, name string) (*StorageObject, error) {
+	info, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, ErrStorageNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "localStorage Stat error")
+	}
+	return s.object(name, info), nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return ErrStorageNotFound
+	}
+	return errors.Wrap(err, "localStorage Remove error")
+}
+
+func (s *localStorage) List(ctx context.Context, prefix string) ([]StorageObject, error) {
+	objects := []StorageObject{}
+
+	dir := s.root
+	if prefix = storageName(prefix); prefix != "" {
+		dir = s.path(prefix)
+	}
+
+	err := filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, filename)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *s.object(filepath.ToSlash(rel), info))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "localStorage Walk error")
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+)
+
+// Хранилище в S3-совместимом сервисе (MinIO, AWS S3 и т.п.)
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3Storage(cfg cfgStorage) (*s3Storage, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(string(cfg.AccessKey), string(cfg.SecretKey), ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "s3Storage New error")
+	}
+
+	s := &s3Storage{client: client, bucket: cfg.Bucket}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3Storage BucketExists error")
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, errors.Wrap(err, "s3Storage MakeBucket error")
+		}
+	}
+
+	return s, nil
+}
+
+func s3Error(err error, message string) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return ErrStorageNotFound
+	}
+	return errors.Wrap(err, message)
+}
+
+func s3Object(info minio.ObjectInfo) *StorageObject {
+	return &StorageObject{
+		Name:     info.Key,
+		Size:     info.Size,
+		ModTime:  info.LastModified,
+		MimeType: info.ContentType,
+	}
+}
+
+func (s *s3Storage) Put(ctx context.Context, name string, r io.Reader, size int64, mime_type string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, storageName(name), r, size, minio.PutObjectOptions{ContentType: mime_type})
+	if err != nil {
+		return errors.Wrap(err, "s3Storage PutObject error")
+	}
+	return nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) (StorageReader, *StorageObject, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, storageName(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s3Error(err, "s3Storage GetObject error")
+	}
+
+	// GetObject не обращается к серверу, ошибки доступа к объекту приходят только при чтении или Stat
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, nil, s3Error(err, "s3Storage Stat error")
+	}
+
+	return obj, s3Object(info), nil
+}
+
+func (s *s3Storage) Stat(ctx context.Context, name string) (*StorageObject, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, storageName(name), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err, "s3Storage StatObject error")
+	}
+	return s3Object(info), nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	if _, err := s.Stat(ctx, name); err != nil {
+		return err
+	}
+
+	if err := s.client.RemoveObject(ctx, s.bucket, storageName(name), minio.RemoveObjectOptions{}); err != nil {
+		return s3Error(err, "s3Storage RemoveObject error")
+	}
+	return nil
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]StorageObject, error) {
+	objects := []StorageObject{}
+
+	opts := minio.ListObjectsOptions{Recursive: true}
+	if prefix = storageName(prefix); prefix != "" {
+		opts.Prefix = prefix + "/"
+	}
+
+	for info := range s.client.ListObjects(ctx, s.bucket, opts) {
+		if info.Err != nil {
+			return nil, s3Error(info.Err, "s3Storage ListObjects error")
+		}
+		objects = append(objects, *s3Object(info))
+	}
+	return objects, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Проверка S3-хранилища на MinIO из docker-compose:
+
+	docker-compose up -d minio
+	S3_TEST_ENDPOINT=localhost:9000 go test -run S3 ./src
+
+Без S3_TEST_ENDPOINT тест пропускается
+*/
+func testS3Storage(t *testing.T) *s3Storage {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT не задан")
+	}
+
+	cfg := cfgStorage{
+		Type:      "s3",
+		Endpoint:  endpoint,
+		Bucket:    fmt.Sprintf("bsight-test-%d", time.Now().UnixNano()),
+		AccessKey: "minio",
+		SecretKey: "minio12345",
+	}
+	if v := os.Getenv("S3_TEST_ACCESS_KEY"); v != "" {
+		cfg.AccessKey = secretString(v)
+	}
+	if v := os.Getenv("S3_TEST_SECRET_KEY"); v != "" {
+		cfg.SecretKey = secretString(v)
+	}
+
+	s, err := newS3Storage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.client.RemoveBucket(context.Background(), cfg.Bucket)
+	})
+	return s
+}
+
+func TestS3StoragePutGetDelete(t *testing.T) {
+	s := testS3Storage(t)
+	ctx := context.Background()
+
+	data := []byte("0123456789")
+	if err := s.Put(ctx, "/logs/1/../2/file.txt", bytes.NewReader(data), int64(len(data)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat(ctx, "logs/2/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "logs/2/file.txt" || info.Size != int64(len(data)) || info.MimeType != "text/plain" {
+		t.Fatalf("Stat: %+v", info)
+	}
+
+	r, _, err := s.Get(ctx, "logs/2/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Seek(5, 0); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tail) != "56789" {
+		t.Fatalf("Get после Seek: %q", tail)
+	}
+
+	list, err := s.List(ctx, "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "logs/2/file.txt" {
+		t.Fatalf("List: %+v", list)
+	}
+
+	if err := s.Delete(ctx, "logs/2/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, "logs/2/file.txt"); err != ErrStorageNotFound {
+		t.Fatalf("Stat после Delete: %v", err)
+	}
+	if _, _, err := s.Get(ctx, "logs/2/file.txt"); err != ErrStorageNotFound {
+		t.Fatalf("Get после Delete: %v", err)
+	}
+	if err := s.Delete(ctx, "logs/2/file.txt"); err != ErrStorageNotFound {
+		t.Fatalf("повторный Delete: %v", err)
+	}
+}
+
+func TestStorageSecretsHiddenInConfigDump(t *testing.T) {
+	cfg := Config{Storage: cfgStorage{AccessKey: "access-key-value", SecretKey: "secret-key-value"}}
+
+	dump := fmt.Sprintf("%+v", cfg)
+	if strings.Contains(dump, "access-key-value") || strings.Contains(dump, "secret-key-value") {
+		t.Fatalf("ключи S3 в выводе конфигурации: %s", dump)
+	}
+}
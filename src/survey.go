@@ -77,6 +77,7 @@ func (h *handler) surveyEventsGet(c jrpc.Context) error {
 	return c.Result(data)
 }
 
+// Ответ на опрос после тренировки. false - ответ не сохранен: уже есть более поздний ответ с платы
 func (h *handler) surveyEventResponse(c jrpc.Context) error {
 	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
 	user_id := claims.ID
@@ -95,7 +96,8 @@ func (h *handler) surveyEventResponse(c jrpc.Context) error {
 		return errors.Wrap(err, "surveyEventResponse Marshal error")
 	}
 
-	if _, err := h.DB.Exec(`select * from api_sight."surveyEventResponse"($1, $2, $3);`, user_id, params.EventId, resp); err != nil {
+	stored, err := h.storeSurveyResponse(nil, SurveyKindEvent, user_id, &params.EventId, nil, resp, time.Now(), nil)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"proc":   "surveyEventResponse",
 			"params": params,
@@ -104,7 +106,7 @@ func (h *handler) surveyEventResponse(c jrpc.Context) error {
 		return errors.Wrap(err, "SQL error")
 	}
 
-	return c.Result(true)
+	return c.Result(stored)
 }
 
 func (h *handler) surveyDailyList(c jrpc.Context) error {
@@ -165,6 +167,7 @@ func (h *handler) surveyDailyGet(c jrpc.Context) error {
 	return c.Result(data)
 }
 
+// Ежедневный опрос. false - ответ не сохранен: уже есть более поздний ответ с платы
 func (h *handler) surveyDailyResponse(c jrpc.Context) error {
 	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
 	user_id := claims.ID
@@ -183,7 +186,8 @@ func (h *handler) surveyDailyResponse(c jrpc.Context) error {
 		return errors.Wrap(err, "surveyEventResponse Marshal error")
 	}
 
-	if _, err := h.DB.Exec(`select * from api_sight."surveyDailyResponse"($1, $2, $3);`, user_id, params.Date, resp); err != nil {
+	stored, err := h.storeSurveyResponse(nil, SurveyKindDaily, user_id, nil, &params.Date, resp, time.Now(), nil)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"proc":   "surveyDailyResponse",
 			"params": params,
@@ -192,7 +196,7 @@ func (h *handler) surveyDailyResponse(c jrpc.Context) error {
 		return errors.Wrap(err, "SQL error")
 	}
 
-	return c.Result(true)
+	return c.Result(stored)
 }
 
 func (h *handler) surveyDailyDays(c jrpc.Context) error {
@@ -235,6 +239,10 @@ func (h *handler) surveyPlayer10Days(c jrpc.Context) error {
 		return errors.Wrap(err, "surveyPlayer10Days Bind error")
 	}
 
+	if player_id := h.requestPlayerID(c); player_id != nil {
+		params.PlayerId = int(*player_id)
+	}
+
 	var data []struct {
 		PlayerId   int        `json:"player_id" db:"player"`
 		PlayerInfo ClubParams `json:"player_info" db:"player_info"`
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Виды опросов: после тренировки и ежедневный
+const (
+	SurveyKindEvent string = "event"
+	SurveyKindDaily string = "daily"
+)
+
+// Результаты сохранения ответов, собранных платой
+const (
+	SurveyStored    string = "stored"
+	SurveyStale     string = "stale"
+	SurveyInvalid   string = "invalid"
+	SurveyForbidden string = "forbidden"
+	SurveyFailed    string = "error"
+)
+
+// Опрос, на который игрок еще не ответил. EventId - для опроса после тренировки, Date - для ежедневного
+type SurveySlot struct {
+	Kind     string     `json:"kind" db:"kind"`
+	UserId   string     `json:"user_id" db:"user_id"`
+	PlayerId int        `json:"player_id" db:"player_id"`
+	EventId  *string    `json:"event_id" db:"event_id"`
+	Date     *time.Time `json:"date" db:"date"`
+}
+
+// Ответ, собранный платой без связи. AnsweredAt - время ответа на плате
+type SurveyBoardResponse struct {
+	Kind       string          `json:"kind"`
+	UserId     string          `json:"user_id"`
+	EventId    *string         `json:"event_id"`
+	Date       *time.Time      `json:"date"`
+	Response   json.RawMessage `json:"response"`
+	AnsweredAt time.Time       `json:"answered_at"`
+}
+
+/*
+Сохранение ответа на опрос через surveyEventResponse или surveyDailyResponse.
+Ответ, данный раньше уже сохраненного, не записывается (stored=false): так разрешается конфликт ответа
+с платы и ответа из приложения. club_id задается для ответов с платы - игрок должен быть из клуба платы
+*/
+func (h *handler) storeSurveyResponse(club_id *int32, kind string, user_id string, event_id *string, date *time.Time, resp []byte, answered_at time.Time, board_id *string) (stored bool, err error) {
+	TX, err := h.DB.Beginx()
+	if err != nil {
+		return false, errors.Wrap(err, "Beginx error")
+	}
+	defer TX.Rollback()
+
+	// Строка ответа блокируется до конца транзакции
+	var member bool
+	var response_time sql.NullTime
+	if err := TX.QueryRow(`select * from api_replication."surveyResponseState"($1, $2, $3, $4, $5);`,
+		club_id, kind, user_id, event_id, date).Scan(&member, &response_time); err != nil {
+		return false, errors.Wrap(err, "surveyResponseState SQL error")
+	}
+	if !member {
+		return false, ErrorForbidden
+	}
+	if response_time.Valid && response_time.Time.After(answered_at) {
+		return false, nil
+	}
+
+	switch kind {
+	case SurveyKindEvent:
+		_, err = TX.Exec(`select * from api_sight."surveyEventResponse"($1, $2, $3);`, user_id, *event_id, resp)
+	case SurveyKindDaily:
+		_, err = TX.Exec(`select * from api_sight."surveyDailyResponse"($1, $2, $3);`, user_id, *date, resp)
+	default:
+		return false, ErrorInvalidParams
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "survey response SQL error")
+	}
+
+	if _, err := TX.Exec(`select * from api_replication."surveyResponseStamp"($1, $2, $3, $4, $5, $6);`,
+		kind, user_id, event_id, date, answered_at, board_id); err != nil {
+		return false, errors.Wrap(err, "surveyResponseStamp SQL error")
+	}
+
+	if err := TX.Commit(); err != nil {
+		return false, errors.Wrap(err, "Commit error")
+	}
+	return true, nil
+}
+
+// Ответ платы приводится к тому же виду, что ответ из приложения
+func (r SurveyBoardResponse) normalize() ([]byte, bool) {
+	switch r.Kind {
+	case SurveyKindEvent:
+		var resp SurveyEvent
+		if r.EventId == nil || json.Unmarshal(r.Response, &resp) != nil {
+			return nil, false
+		}
+		data, err := json.Marshal(resp)
+		return data, err == nil
+	case SurveyKindDaily:
+		var resp ClubParams
+		if r.Date == nil || json.Unmarshal(r.Response, &resp) != nil {
+			return nil, false
+		}
+		data, err := json.Marshal(resp)
+		return data, err == nil
+	}
+	return nil, false
+}
+
+// Действующие шаблоны опросов клуба платы
+func (h *handler) replicationSurveyTemplates(c jrpc.Context) error {
+	club_id := c.EchoContext().Get("club_id").(int32)
+
+	data := []json.RawMessage{}
+	if err := h.DB.Select(&data, `select * from api_replication."surveyTemplates"($1);`, club_id); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "replicationSurveyTemplates",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+// Неотвеченные опросы игроков клуба платы
+func (h *handler) replicationSurveyPending(c jrpc.Context) error {
+	club_id := c.EchoContext().Get("club_id").(int32)
+
+	data := []SurveySlot{}
+	if err := h.DB.Select(&data, `select * from api_replication."surveyPending"($1);`, club_id); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "replicationSurveyPending",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+/*
+Ответы, собранные платой. Каждый ответ сохраняется отдельно, в результате - статус по каждому
+в порядке передачи: stored, stale (уже есть более поздний ответ), invalid, forbidden или error.
+Время ответа позже текущего считается текущим
+*/
+func (h *handler) replicationSurveyPush(c jrpc.Context) error {
+	club_id := c.EchoContext().Get("club_id").(int32)
+	board_id := c.EchoContext().Get("board_id").(string)
+
+	var params []SurveyBoardResponse
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "replicationSurveyPush Bind error")
+	}
+
+	result := make([]string, len(params))
+	for i, item := range params {
+		resp, ok := item.normalize()
+		if !ok || item.UserId == "" || item.AnsweredAt.IsZero() {
+			result[i] = SurveyInvalid
+			continue
+		}
+		// Часы платы могут спешить: ответ "из будущего" перекрыл бы все следующие ответы из приложения
+		if now := time.Now(); item.AnsweredAt.After(now) {
+			item.AnsweredAt = now
+		}
+
+		stored, err := h.storeSurveyResponse(&club_id, item.Kind, item.UserId, item.EventId, item.Date, resp, item.AnsweredAt, &board_id)
+		switch {
+		case err == ErrorForbidden:
+			result[i] = SurveyForbidden
+		case err != nil:
+			log.WithFields(log.Fields{
+				"proc":     "replicationSurveyPush",
+				"board_id": board_id,
+				"user_id":  item.UserId,
+				"kind":     item.Kind,
+				"error":    err,
+			}).Error("SQL error")
+			result[i] = SurveyFailed
+		case stored:
+			result[i] = SurveyStored
+		default:
+			result[i] = SurveyStale
+		}
+	}
+
+	return c.Result(result)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/golang-jwt/jwt"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type cfgTunnels struct {
+	DefaultTTL time.Duration `env:"TUNNELS_DEFAULT_TTL" envDefault:"1h"`
+	MaxTTL     time.Duration `env:"TUNNELS_MAX_TTL" envDefault:"24h"`
+}
+
+/*
+Состояния туннеля поддержки: запрошен администратором, команда открытия передана плате (opened),
+запрошено закрытие (closing), команда закрытия передана плате (closed)
+*/
+const (
+	TunnelRequested string = "requested"
+	TunnelOpened    string = "opened"
+	TunnelClosing   string = "closing"
+	TunnelClosed    string = "closed"
+)
+
+type TunnelInfo struct {
+	Id          int64      `json:"id" db:"id"`
+	BoardId     string     `json:"board_id" db:"board_id"`
+	ClubId      int32      `json:"club_id" db:"club_id"`
+	State       string     `json:"state" db:"state"`
+	Reason      *string    `json:"reason" db:"reason"`
+	ExpiresAt   time.Time  `json:"expires_at" db:"expires_at"`
+	RequestedBy string     `json:"requested_by" db:"requested_by"`
+	ClosedBy    *string    `json:"closed_by" db:"closed_by"`
+	CreateTime  time.Time  `json:"create_time" db:"create_time"`
+	UpdateTime  *time.Time `json:"update_time" db:"update_time"`
+}
+
+func (t *TunnelInfo) expired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
+
+/*
+Туннель для администратора: с истекшим сроком показывается закрытым, даже если плата еще
+не опросила ssh.dn или туннель так и не был ей передан
+*/
+func (t *TunnelInfo) reported(now time.Time) TunnelInfo {
+	tunnel := *t
+	if tunnel.State != TunnelClosed && tunnel.expired(now) {
+		tunnel.State = TunnelClosed
+	}
+	return tunnel
+}
+
+// Последний незакрытый туннель платы, nil если его нет
+func (h *handler) boardTunnel(board_id string) (*TunnelInfo, error) {
+	var tunnel TunnelInfo
+	err := h.DB.Get(&tunnel, `select * from api_replication."tunnelsCurrent"($1);`, board_id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "tunnelsCurrent SQL error")
+	}
+	return &tunnel, nil
+}
+
+func (h *handler) setTunnelState(tunnel *TunnelInfo, state string) error {
+	if _, err := h.DB.Exec(`select * from api_replication."tunnelsSetState"($1, $2);`, tunnel.Id, state); err != nil {
+		return errors.Wrap(err, "tunnelsSetState SQL error")
+	}
+
+	log.WithFields(log.Fields{
+		"proc":      "setTunnelState",
+		"tunnel_id": tunnel.Id,
+		"board_id":  tunnel.BoardId,
+		"state":     state,
+	}).Info("Tunnel state changed")
+	return nil
+}
+
+/*
+Опрос платы: нужно ли поднять туннель. true, пока есть запрос и не истек его срок
+*/
+func (h *handler) sshUp(c jrpc.Context) error {
+	board_id := c.EchoContext().Get("board_id").(string)
+
+	tunnel, err := h.boardTunnel(board_id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "sshUp",
+			"board_id": board_id,
+			"error":    err,
+		}).Error("SQL error")
+		return err
+	}
+
+	if tunnel == nil || tunnel.expired(time.Now()) {
+		return c.Result(false)
+	}
+
+	switch tunnel.State {
+	case TunnelRequested:
+		if err := h.setTunnelState(tunnel, TunnelOpened); err != nil {
+			return err
+		}
+		return c.Result(true)
+	case TunnelOpened:
+		return c.Result(true)
+	}
+	return c.Result(false)
+}
+
+/*
+Опрос платы: нужно ли закрыть туннель. true после запроса закрытия или по истечении срока открытого туннеля.
+Запрос, срок которого истек до передачи плате, закрывается без команды: плата туннель не открывала
+*/
+func (h *handler) sshDown(c jrpc.Context) error {
+	board_id := c.EchoContext().Get("board_id").(string)
+
+	tunnel, err := h.boardTunnel(board_id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "sshDown",
+			"board_id": board_id,
+			"error":    err,
+		}).Error("SQL error")
+		return err
+	}
+
+	if tunnel == nil {
+		return c.Result(false)
+	}
+
+	expired := tunnel.expired(time.Now())
+	switch {
+	case tunnel.State == TunnelRequested && expired:
+		if err := h.setTunnelState(tunnel, TunnelClosed); err != nil {
+			return err
+		}
+		return c.Result(false)
+	case tunnel.State == TunnelClosing, tunnel.State == TunnelOpened && expired:
+		if err := h.setTunnelState(tunnel, TunnelClosed); err != nil {
+			return err
+		}
+		return c.Result(true)
+	}
+	return c.Result(false)
+}
+
+// Запрос туннеля к плате на ttl секунд
+func (h *handler) adminTunnelsOpen(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params struct {
+		BoardId string  `json:"board_id"`
+		TTL     int64   `json:"ttl"`
+		Reason  *string `json:"reason"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return errors.Wrap(err, "adminTunnelsOpen Bind error")
+	}
+
+	ttl := time.Duration(params.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = h.cfg.Tunnels.DefaultTTL
+	}
+	if ttl > h.cfg.Tunnels.MaxTTL {
+		return ErrorInvalidParams
+	}
+
+	var data TunnelInfo
+	err := h.DB.Get(&data, `select * from api_sight."tunnelsRequest"($1, $2, $3, $4);`, params.BoardId, time.Now().Add(ttl), params.Reason, claims.ID)
+	if err == sql.ErrNoRows {
+		return ErrorNotFound
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":     "adminTunnelsOpen",
+			"board_id": params.BoardId,
+			"error":    err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+/*
+Досрочное закрытие туннеля. Плата получит команду при следующем опросе ssh.dn.
+Туннель, еще не переданный плате, tunnelsClose закрывает сразу (closed), без команды
+*/
+func (h *handler) adminTunnelsClose(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var id int64
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "adminTunnelsClose Bind error")
+	}
+
+	var data TunnelInfo
+	err := h.DB.Get(&data, `select * from api_sight."tunnelsClose"($1, $2);`, id, claims.ID)
+	if err == sql.ErrNoRows {
+		return ErrorNotFound
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":      "adminTunnelsClose",
+			"tunnel_id": id,
+			"error":     err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data.reported(time.Now()))
+}
+
+// Туннели плат. active - только незакрытые туннели с неистекшим сроком
+func (h *handler) adminTunnelsList(c jrpc.Context) error {
+	var params struct {
+		BoardId *string `json:"board_id"`
+		Active  bool    `json:"active"`
+	}
+
+	// Параметры необязательны
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+
+	var rows []TunnelInfo
+	if err := h.DB.Select(&rows, `select * from api_sight."tunnelsList"($1, $2);`, params.BoardId, params.Active); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "adminTunnelsList",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	now := time.Now()
+	data := make([]TunnelInfo, 0, len(rows))
+	for i := range rows {
+		tunnel := rows[i].reported(now)
+		if params.Active && tunnel.State == TunnelClosed {
+			continue
+		}
+		data = append(data, tunnel)
+	}
+
+	return c.Result(data)
+}
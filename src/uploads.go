@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/mrFokin/jrpc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type cfgUploads struct {
+	Interval time.Duration `env:"UPLOADS_RETENTION_INTERVAL" envDefault:"24h"`
+	// Срок хранения файлов, 0 - хранить бессрочно
+	RawRetention  time.Duration `env:"UPLOADS_RAW_RETENTION" envDefault:"0"`
+	LogsRetention time.Duration `env:"UPLOADS_LOGS_RETENTION" envDefault:"0"`
+}
+
+// Виды файлов, которые загружают платы. Совпадают с каталогом в хранилище
+const (
+	UploadKindLogs string = "logs"
+	UploadKindRaw  string = "raw"
+)
+
+// Запись каталога загруженных платами логов и сырых данных датчиков
+type BoardUploadInfo struct {
+	Id             int64     `json:"id" db:"id"`
+	ClubId         int32     `json:"club_id" db:"club_id"`
+	BoardId        string    `json:"board_id" db:"board_id"`
+	Kind           string    `json:"kind" db:"kind"`
+	FileName       string    `json:"name" db:"name"`
+	FileSystemName string    `json:"-" db:"fs_name"`
+	FileSize       int64     `json:"size" db:"size"`
+	MimeType       string    `json:"type" db:"type"`
+	Hash           string    `json:"sha256" db:"sha256"`
+	EventId        *string   `json:"event_id" db:"event_id"`
+	UploadTime     time.Time `json:"upload_time" db:"upload_time"`
+}
+
+type BoardUploadsListParams struct {
+	ClubId    *int32     `json:"club_id"`
+	Kind      *string    `json:"kind"`
+	BoardId   *string    `json:"board_id"`
+	EventId   *string    `json:"event_id"`
+	StartTime *time.Time `json:"start_time"`
+	StopTime  *time.Time `json:"stop_time"`
+	Limit     int        `json:"limit"`
+}
+
+/*
+Сохраняет загруженный платой файл и запись о нем в каталоге. Имя в хранилище включает
+начало SHA-256, поэтому файлы с одинаковым именем не перезаписывают друг друга.
+Повторная загрузка того же содержимого возвращает существующую запись
+*/
+func (h *handler) storeBoardUpload(ctx context.Context, club_id int32, board_id string, kind string, filename string, src io.ReadSeeker, size int64, mime_type string, event_id *string) (upload BoardUploadInfo, err error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, src); err != nil {
+		return upload, errors.Wrap(err, "storeBoardUpload read error")
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	err = h.DB.Get(&upload, `select * from api_replication."boardUploadsFind"($1, $2, $3, $4);`, club_id, board_id, kind, hash)
+	if err == nil {
+		return upload, nil
+	}
+	if err != sql.ErrNoRows {
+		return upload, errors.Wrap(err, "boardUploadsFind SQL error")
+	}
+
+	name := storageName(kind, strconv.Itoa(int(club_id)), board_id, hash[:16]+"-"+filename)
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return upload, errors.Wrap(err, "storeBoardUpload seek error")
+	}
+	if err := h.storage.Put(ctx, name, src, size, mime_type); err != nil {
+		return upload, err
+	}
+
+	err = h.DB.Get(&upload, `select * from api_replication."boardUploadsAdd"($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
+		club_id, board_id, kind, filename, name, size, mime_type, hash, event_id)
+	if err != nil {
+		return upload, errors.Wrap(err, "boardUploadsAdd SQL error")
+	}
+	return upload, nil
+}
+
+func (h *handler) boardUploadsList(params BoardUploadsListParams) ([]BoardUploadInfo, error) {
+	if params.Limit <= 0 {
+		params.Limit = listDefaultLimit
+	}
+	if params.Limit > listMaxLimit {
+		params.Limit = listMaxLimit
+	}
+
+	data := []BoardUploadInfo{}
+	err := h.DB.Select(&data, `select * from api_sight."boardUploadsList"($1, $2, $3, $4, $5, $6, $7);`,
+		params.ClubId, params.Kind, params.BoardId, params.EventId, params.StartTime, params.StopTime, params.Limit)
+	return data, err
+}
+
+// Удаляет запись каталога и файл. club_id = nil - без ограничения по клубу
+func (h *handler) boardUploadsRemove(ctx context.Context, club_id *int32, id int64, user_id *string) error {
+	var fs_name sql.NullString
+	if err := h.DB.Get(&fs_name, `select * from api_sight."boardUploadsRm"($1, $2, $3);`, club_id, id, user_id); err != nil {
+		return errors.Wrap(err, "boardUploadsRm SQL error")
+	}
+	if !fs_name.Valid {
+		return ErrorNotFound
+	}
+
+	if err := h.storage.Delete(ctx, fs_name.String); err != nil && err != ErrStorageNotFound {
+		return err
+	}
+	return nil
+}
+
+func (h *handler) serveBoardUpload(c echo.Context, club_id *int32, id string) error {
+	var upload BoardUploadInfo
+	if err := h.DB.Get(&upload, `select * from api_sight."boardUploadsGet"($1, $2);`, club_id, id); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": upload.FileName}))
+	return h.serveStorageFile(c, upload.FileSystemName, upload.MimeType, upload.Hash)
+}
+
+// Загрузки плат клуба
+func (h *handler) uploadsList(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var params BoardUploadsListParams
+
+	// Параметры необязательны
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+	club_id, err := claimsClubID(claims)
+	if err != nil {
+		return err
+	}
+	params.ClubId = club_id
+
+	data, err := h.boardUploadsList(params)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "uploadsList",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+func (h *handler) uploadsDelete(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var id int64
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "uploadsDelete Bind error")
+	}
+
+	club_id, err := claimsClubID(claims)
+	if err != nil {
+		return err
+	}
+
+	if err := h.boardUploadsRemove(c.EchoContext().Request().Context(), club_id, id, &claims.ID); err != nil {
+		if err == ErrorNotFound {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"proc":      "uploadsDelete",
+			"upload_id": id,
+			"error":     err,
+		}).Error("Remove error")
+		return errors.Wrap(err, "uploadsDelete error")
+	}
+
+	return c.Result(true)
+}
+
+func (h *handler) getBoardUpload(c echo.Context) error {
+	claims := c.Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	if claimsPlayerID(claims) != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
+	club_id, err := claimsClubID(claims)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
+	return h.serveBoardUpload(c, club_id, c.Param("id"))
+}
+
+// Загрузки плат всех клубов, club_id в параметрах ограничивает выборку одним клубом
+func (h *handler) adminUploadsList(c jrpc.Context) error {
+	var params BoardUploadsListParams
+
+	// Параметры необязательны
+	if err := bindOptional(c, &params); err != nil {
+		return err
+	}
+
+	data, err := h.boardUploadsList(params)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "adminUploadsList",
+			"error": err,
+		}).Error("SQL error")
+		return errors.Wrap(err, "SQL error")
+	}
+
+	return c.Result(data)
+}
+
+func (h *handler) adminUploadsDelete(c jrpc.Context) error {
+	claims := c.EchoContext().Get("user").(*jwt.Token).Claims.(*UserClaims)
+
+	var id int64
+
+	if err := c.Bind(&id); err != nil {
+		return errors.Wrap(err, "adminUploadsDelete Bind error")
+	}
+
+	if err := h.boardUploadsRemove(c.EchoContext().Request().Context(), nil, id, &claims.ID); err != nil {
+		if err == ErrorNotFound {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"proc":      "adminUploadsDelete",
+			"upload_id": id,
+			"error":     err,
+		}).Error("Remove error")
+		return errors.Wrap(err, "adminUploadsDelete error")
+	}
+
+	return c.Result(true)
+}
+
+func (h *handler) adminGetBoardUpload(c echo.Context) error {
+	return h.serveBoardUpload(c, nil, c.Param("id"))
+}
+
+// Удаляет загрузки старше срока хранения своего вида. Возвращает число удаленных
+func (h *handler) expireBoardUploads(ctx context.Context, kind string, retention time.Duration) (removed int, err error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+
+	var expired []BoardUploadInfo
+	if err := h.DB.Select(&expired, `select * from api_sight."boardUploadsExpired"($1, $2);`, kind, time.Now().Add(-retention)); err != nil {
+		return 0, errors.Wrap(err, "boardUploadsExpired SQL error")
+	}
+
+	for _, upload := range expired {
+		if err := h.boardUploadsRemove(ctx, nil, upload.Id, nil); err != nil {
+			log.WithFields(log.Fields{
+				"proc":      "expireBoardUploads",
+				"upload_id": upload.Id,
+				"error":     err,
+			}).Error("Remove error")
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Периодическое удаление загрузок по сроку хранения (UPLOADS_RAW_RETENTION, UPLOADS_LOGS_RETENTION)
+// и брошенных незавершенных загрузок
+func (h *handler) runUploadsRetention(ctx context.Context) {
+	if h.cfg.Uploads.Interval <= 0 {
+		return
+	}
+
+	retention := map[string]time.Duration{
+		UploadKindRaw:  h.cfg.Uploads.RawRetention,
+		UploadKindLogs: h.cfg.Uploads.LogsRetention,
+	}
+
+	ticker := time.NewTicker(h.cfg.Uploads.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if removed, err := h.expireResumableUploads(ctx); err != nil {
+			log.WithFields(log.Fields{
+				"proc":  "runUploadsRetention",
+				"error": err,
+			}).Error("SQL error")
+		} else if removed > 0 {
+			log.WithFields(log.Fields{
+				"proc":    "runUploadsRetention",
+				"removed": removed,
+			}).Info("Expired resumable uploads removed")
+		}
+
+		for kind, period := range retention {
+			removed, err := h.expireBoardUploads(ctx, kind, period)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"proc":  "runUploadsRetention",
+					"kind":  kind,
+					"error": err,
+				}).Error("Uploads retention error")
+				continue
+			}
+			if removed > 0 {
+				log.WithFields(log.Fields{
+					"proc":    "runUploadsRetention",
+					"kind":    kind,
+					"removed": removed,
+				}).Info("Expired uploads removed")
+			}
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/PCManiac/logrus_init"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type cfgResumable struct {
+	// Каталог временных файлов для проверки частей и сборки файла. По умолчанию системный
+	Dir     string        `env:"UPLOADS_RESUMABLE_PATH" envDefault:""`
+	MaxSize int64         `env:"UPLOADS_RESUMABLE_MAX_SIZE" envDefault:"4294967296"`
+	TTL     time.Duration `env:"UPLOADS_RESUMABLE_TTL" envDefault:"72h"`
+}
+
+/*
+Докачка больших файлов платами по мотивам протокола tus. Плата создает загрузку (POST /replication/uploads),
+отправляет части PATCH с заголовком Upload-Offset и необязательным Upload-Checksum: sha256 <base64>,
+после обрыва узнает смещение через HEAD и завершает загрузку проверкой SHA-256 всего файла (POST .../finalize).
+Состояние загрузки хранится в БД, принятые части - отдельными объектами в хранилище,
+поэтому части одной загрузки могут приходить на разные экземпляры API
+*/
+type ResumableUpload struct {
+	Id         string    `json:"id" db:"id"`
+	ClubId     int32     `json:"club_id" db:"club_id"`
+	BoardId    string    `json:"board_id" db:"board_id"`
+	Kind       string    `json:"kind" db:"kind"`
+	FileName   string    `json:"name" db:"name"`
+	FileSize   int64     `json:"size" db:"size"`
+	MimeType   string    `json:"type" db:"type"`
+	EventId    *string   `json:"event_id" db:"event_id"`
+	CreateTime time.Time `json:"create_time" db:"create_time"`
+	Offset     int64     `json:"offset" db:"offset"`
+}
+
+// Принятая часть загрузки: с какого смещения, размер и объект в хранилище
+type ResumablePart struct {
+	Offset int64  `db:"offset"`
+	Size   int64  `db:"size"`
+	Name   string `db:"fs_name"`
+}
+
+const (
+	headerUploadOffset   = "Upload-Offset"
+	headerUploadLength   = "Upload-Length"
+	headerUploadChecksum = "Upload-Checksum"
+)
+
+// Каталог хранилища с частями незавершенных загрузок
+const resumablePrefix string = "resumable"
+
+var (
+	ErrResumableNotFound = errors.New("upload not found")
+	ErrResumableOffset   = errors.New("upload offset mismatch")
+	ErrResumableChecksum = errors.New("checksum mismatch")
+)
+
+// id загрузки - 16 случайных байт в hex
+func resumableValidId(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
+
+/*
+Имя объекта части. Случайный суффикс не дает параллельному повтору той же части перезаписать
+уже принятый объект: в БД попадет только одна из них, объект второй удаляется
+*/
+func resumablePartName(id string, offset int64) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return storageName(resumablePrefix, id, fmt.Sprintf("%020d-%s", offset, hex.EncodeToString(suffix))), nil
+}
+
+// Загрузка этой платы. Смещение - суммарный размер уже принятых частей
+func (h *handler) resumableLoad(c echo.Context, id string) (upload ResumableUpload, err error) {
+	err = h.DB.Get(&upload, `select * from api_replication."resumableGet"($1, $2, $3);`,
+		id, c.Get("club_id").(int32), c.Get("board_id").(string))
+	if err == sql.ErrNoRows {
+		return upload, ErrResumableNotFound
+	}
+	if err != nil {
+		return upload, errors.Wrap(err, "resumableGet SQL error")
+	}
+	return upload, nil
+}
+
+// Удаляет объекты частей. Ошибки только пишутся в лог: оставшиеся объекты не мешают работе
+func (h *handler) resumableRemoveParts(ctx context.Context, names []string) {
+	for _, name := range names {
+		if err := h.storage.Delete(ctx, name); err != nil && err != ErrStorageNotFound {
+			log.WithFields(log.Fields{
+				"proc":  "resumableRemoveParts",
+				"name":  name,
+				"error": err,
+			}).Error("Delete error")
+		}
+	}
+}
+
+// Удаляет загрузку из БД и ее части из хранилища
+func (h *handler) resumableRemove(ctx context.Context, id string) error {
+	var names pq.StringArray
+	if err := h.DB.Get(&names, `select * from api_replication."resumableDelete"($1);`, id); err != nil {
+		return errors.Wrap(err, "resumableDelete SQL error")
+	}
+	h.resumableRemoveParts(ctx, names)
+	return nil
+}
+
+func resumableError(err error) error {
+	switch err {
+	case ErrResumableNotFound:
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case ErrResumableOffset:
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case ErrResumableChecksum:
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+}
+
+func resumableHeaders(c echo.Context, upload ResumableUpload) {
+	header := c.Response().Header()
+	header.Set(headerUploadOffset, strconv.FormatInt(upload.Offset, 10))
+	header.Set(headerUploadLength, strconv.FormatInt(upload.FileSize, 10))
+	header.Set("Cache-Control", "no-store")
+}
+
+func (h *handler) resumableCreate(c echo.Context) error {
+	var params struct {
+		FileName string  `json:"name"`
+		FileSize int64   `json:"size"`
+		Kind     string  `json:"kind"`
+		MimeType string  `json:"type"`
+		EventId  *string `json:"event_id"`
+	}
+
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if params.Kind == "" {
+		params.Kind = UploadKindRaw
+	}
+	if params.Kind != UploadKindRaw && params.Kind != UploadKindLogs {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown kind")
+	}
+	if params.FileName == "" || params.FileSize <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "name and size are required")
+	}
+	if params.FileSize > h.cfg.Resumable.MaxSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "file is too large")
+	}
+	if params.MimeType == "" {
+		params.MimeType = "application/octet-stream"
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	var upload ResumableUpload
+	if err := h.DB.Get(&upload, `select * from api_replication."resumableCreate"($1, $2, $3, $4, $5, $6, $7, $8);`,
+		hex.EncodeToString(id), c.Get("club_id").(int32), c.Get("board_id").(string), params.Kind,
+		filepath.Base(params.FileName), params.FileSize, params.MimeType, params.EventId); err != nil {
+		log.WithFields(log.Fields{
+			"proc":  "resumableCreate",
+			"error": err,
+		}).Error("SQL error")
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	resumableHeaders(c, upload)
+	c.Response().Header().Set(echo.HeaderLocation, strings.TrimSuffix(c.Request().URL.Path, "/")+"/"+upload.Id)
+	return c.JSON(http.StatusCreated, upload)
+}
+
+func (h *handler) resumableOffset(c echo.Context) error {
+	id := c.Param("id")
+	if !resumableValidId(id) {
+		return resumableError(ErrResumableNotFound)
+	}
+
+	upload, err := h.resumableLoad(c, id)
+	if err != nil {
+		return resumableError(err)
+	}
+
+	resumableHeaders(c, upload)
+	return c.JSON(http.StatusOK, upload)
+}
+
+/*
+Принимает часть с позиции Upload-Offset. Позиция должна совпадать с уже принятым размером,
+поэтому повтор части после обрыва связи отклоняется с 409 и плата запрашивает смещение заново.
+Часть сначала сохраняется во временный файл: оборванная, слишком большая или с неверной
+контрольной суммой часть отбрасывается целиком. Принятая часть записывается в хранилище,
+смещение в БД сдвигается, только если за это время его не сдвинул параллельный запрос
+*/
+func (h *handler) resumablePatch(c echo.Context) error {
+	id := c.Param("id")
+	if !resumableValidId(id) {
+		return resumableError(ErrResumableNotFound)
+	}
+
+	upload, err := h.resumableLoad(c, id)
+	if err != nil {
+		return resumableError(err)
+	}
+
+	offset, err := strconv.ParseInt(c.Request().Header.Get(headerUploadOffset), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Upload-Offset header is required")
+	}
+	if offset != upload.Offset {
+		resumableHeaders(c, upload)
+		return resumableError(ErrResumableOffset)
+	}
+
+	var checksum []byte
+	if value := c.Request().Header.Get(headerUploadChecksum); value != "" {
+		parts := strings.SplitN(value, " ", 2)
+		if len(parts) != 2 || strings.ToLower(parts[0]) != "sha256" {
+			return echo.NewHTTPError(http.StatusBadRequest, "unsupported checksum algorithm")
+		}
+		if checksum, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	chunk, err := ioutil.TempFile(h.cfg.Resumable.Dir, "chunk-")
+	if err != nil {
+		return resumableError(err)
+	}
+	defer os.Remove(chunk.Name())
+	defer chunk.Close()
+
+	hasher := sha256.New()
+	remaining := upload.FileSize - upload.Offset
+	written, err := io.Copy(io.MultiWriter(chunk, hasher), io.LimitReader(c.Request().Body, remaining+1))
+
+	switch {
+	case err != nil:
+		log.WithFields(log.Fields{
+			"proc":      "resumablePatch",
+			"upload_id": id,
+			"board_id":  upload.BoardId,
+			"offset":    upload.Offset,
+			"error":     err,
+		}).Warn("Chunk interrupted")
+		resumableHeaders(c, upload)
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case written > remaining:
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "chunk exceeds upload size")
+	case checksum != nil && !bytes.Equal(checksum, hasher.Sum(nil)):
+		return resumableError(ErrResumableChecksum)
+	case written == 0:
+		resumableHeaders(c, upload)
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	name, err := resumablePartName(id, offset)
+	if err != nil {
+		return resumableError(err)
+	}
+	if _, err := chunk.Seek(0, io.SeekStart); err != nil {
+		return resumableError(err)
+	}
+	ctx := c.Request().Context()
+	if err := h.storage.Put(ctx, name, chunk, written, "application/octet-stream"); err != nil {
+		return resumableError(err)
+	}
+
+	// null - смещение уже сдвинула другая часть или загрузка удалена
+	var next *int64
+	if err := h.DB.Get(&next, `select * from api_replication."resumablePartAdd"($1, $2, $3, $4);`, id, offset, written, name); err != nil {
+		h.resumableRemoveParts(ctx, []string{name})
+		log.WithFields(log.Fields{
+			"proc":      "resumablePatch",
+			"upload_id": id,
+			"error":     err,
+		}).Error("SQL error")
+		return resumableError(err)
+	}
+	if next == nil {
+		h.resumableRemoveParts(ctx, []string{name})
+		if upload, err = h.resumableLoad(c, id); err != nil {
+			return resumableError(err)
+		}
+		resumableHeaders(c, upload)
+		return resumableError(ErrResumableOffset)
+	}
+
+	upload.Offset = *next
+	resumableHeaders(c, upload)
+	return c.NoContent(http.StatusNoContent)
+}
+
+/*
+Проверяет, что файл принят целиком и его SHA-256 совпадает с переданным платой,
+и переносит его в хранилище с записью в каталоге загрузок. Части собираются во временный файл
+*/
+func (h *handler) resumableFinalize(c echo.Context) error {
+	id := c.Param("id")
+	if !resumableValidId(id) {
+		return resumableError(ErrResumableNotFound)
+	}
+
+	var params struct {
+		Hash string `json:"sha256"`
+	}
+
+	if err := c.Bind(&params); err != nil || params.Hash == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "sha256 is required")
+	}
+
+	upload, err := h.resumableLoad(c, id)
+	if err != nil {
+		return resumableError(err)
+	}
+	if upload.Offset != upload.FileSize {
+		resumableHeaders(c, upload)
+		return resumableError(ErrResumableOffset)
+	}
+
+	var parts []ResumablePart
+	if err := h.DB.Select(&parts, `select * from api_replication."resumableParts"($1);`, id); err != nil {
+		return resumableError(errors.Wrap(err, "resumableParts SQL error"))
+	}
+
+	file, err := ioutil.TempFile(h.cfg.Resumable.Dir, "upload-")
+	if err != nil {
+		return resumableError(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	ctx := c.Request().Context()
+	hasher := sha256.New()
+	for _, part := range parts {
+		r, _, err := h.storage.Get(ctx, part.Name)
+		if err != nil {
+			return resumableError(err)
+		}
+		_, err = io.Copy(io.MultiWriter(file, hasher), r)
+		r.Close()
+		if err != nil {
+			return resumableError(err)
+		}
+	}
+
+	if !strings.EqualFold(params.Hash, hex.EncodeToString(hasher.Sum(nil))) {
+		// Файл собран неверно, докачать его уже нельзя
+		if err := h.resumableRemove(ctx, id); err != nil {
+			return resumableError(err)
+		}
+		return resumableError(ErrResumableChecksum)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return resumableError(err)
+	}
+
+	stored, err := h.storeBoardUpload(ctx, upload.ClubId, upload.BoardId, upload.Kind, upload.FileName, file, upload.FileSize, upload.MimeType, upload.EventId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"proc":      "resumableFinalize",
+			"upload_id": id,
+			"error":     err,
+		}).Error("Store error")
+		return resumableError(err)
+	}
+
+	if err := h.resumableRemove(ctx, id); err != nil {
+		log.WithFields(log.Fields{
+			"proc":      "resumableFinalize",
+			"upload_id": id,
+			"error":     err,
+		}).Error("SQL error")
+	}
+
+	return c.JSON(http.StatusOK, stored)
+}
+
+func (h *handler) resumableAbort(c echo.Context) error {
+	id := c.Param("id")
+	if !resumableValidId(id) {
+		return resumableError(ErrResumableNotFound)
+	}
+
+	if _, err := h.resumableLoad(c, id); err != nil {
+		return resumableError(err)
+	}
+
+	if err := h.resumableRemove(c.Request().Context(), id); err != nil {
+		return resumableError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Удаляет незавершенные загрузки, в которые не поступало частей дольше UPLOADS_RESUMABLE_TTL
+func (h *handler) expireResumableUploads(ctx context.Context) (removed int, err error) {
+	var expired []struct {
+		Id    string         `db:"id"`
+		Names pq.StringArray `db:"fs_names"`
+	}
+	if err := h.DB.Select(&expired, `select * from api_replication."resumableExpire"($1);`, time.Now().Add(-h.cfg.Resumable.TTL)); err != nil {
+		return 0, errors.Wrap(err, "resumableExpire SQL error")
+	}
+
+	for _, upload := range expired {
+		h.resumableRemoveParts(ctx, upload.Names)
+	}
+	return len(expired), nil
+}